@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// newAllowlist is a function to index names of allowlist, which are never blocked
+// a name is exact ("www.example.com"), a wildcard ("*.example.com") or a zone (".example.com"), see labelTrie
+func newAllowlist(names []string) *hostsStore {
+	var entries []hostsEntry
+	for _, name := range names {
+		entries = append(entries, hostsEntry{names: []string{strings.TrimSuffix(name, ".")}, path: "allowlist"})
+	}
+	return newHostsStore(entries)
+}
+
+// checkAllowlist is a function to check every name of allowlist
+func checkAllowlist(names []string) error {
+	for _, name := range names {
+		if err := checkHostName(name); err != nil {
+			return fmt.Errorf("allowlist %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// lookupLocal is a function to find the local answer of name: hosts files first, then blocklists
+// the allowlist is checked before any block rule, so a name it matches is only found if hosts files map it to addresses,
+// its block records dropped; source tells where match comes from, and allowed is the allowlist rule which overrides a block rule
+func (r *relay) lookupLocal(name string) (match hostsMatch, source string, found bool, allowed string) {
+	allow, isAllowed := r.allow.match(name)
+	if match, found = r.hosts.current().match(name); found {
+		if _, blocked := blockModeOf(match.records, r.cfg.BlockMode); !blocked || !isAllowed {
+			return match, "hosts", true, ""
+		}
+		if match.records = unblockedRecords(match.records); len(match.records) > 0 {
+			return match, "hosts", true, allow.rule
+		}
+		return hostsMatch{}, "hosts", false, allow.rule
+	}
+	if match, found = r.blocks.match(name); found && isAllowed {
+		return hostsMatch{}, "blocklist", false, allow.rule
+	}
+	return match, "blocklist", found, ""
+}
+
+// unblockedRecords is a function to drop records blocking a name, keeping the addresses it's mapped to
+// records is shared by the hosts store, so the kept ones are copied
+func unblockedRecords(records []hostsRecord) (kept []hostsRecord) {
+	for _, record := range records {
+		if record.block == "" && !isBlockedIP(record.ip) {
+			kept = append(kept, record)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestAllowlist(t *testing.T) {
+	r := testRelay("0.0.0.0 ads.example.com\n0.0.0.0 *.tracker.example.com\n10.0.0.1 www.example.com\n" +
+		"0.0.0.0 ok.example.org\nrefused .example.net\n")
+	r.pool = newUpstreamPool(nil, strategyFailover, 1)
+	r.cfg.Retries = 0
+	blocked, allowed, _, _, _ := parseBlocklist(strings.NewReader("||list.example.com^\n"), "test", formatAdblock)
+	r.blocks = &blockStore{blocked: newHostsStore(blocked), allowed: newHostsStore(allowed)}
+	r.allow = newAllowlist([]string{"OK.example.org.", "*.tracker.example.com", ".list.example.com", "www.example.com", "a.example.net"})
+
+	cases := []struct {
+		name  string
+		rcode uint8
+	}{
+		// allowed names go to remote DNS, which is absent here
+		{"ok.example.org", 2},
+		{"cdn.tracker.example.com", 2},
+		{"a.list.example.com", 2},
+		{"list.example.com", 2},
+		{"a.example.net", 2},
+		// allowlist doesn't change names not blocked
+		{"www.example.com", 0},
+		// the rest are still blocked
+		{"ads.example.com", 3},
+		{"b.example.net", 5},
+	}
+	for _, c := range cases {
+		m := testExchange(t, r, testQuery(1, c.name))
+		if rcode := m.Hdr.parseFlags().RCODE; rcode != c.rcode {
+			t.Errorf("%s: rcode %d, want %d", c.name, rcode, c.rcode)
+		}
+	}
+
+	for _, args := range [][]string{{"-allowlist", "bad..example.com"}, {"-allowlist", "a.*.example.com"}} {
+		if _, err := loadConfig(args); err == nil {
+			t.Errorf("config %v should be rejected", args)
+		}
+	}
+	if cfg, err := loadConfig([]string{"-allowlist", "*.example.com, www.example.org"}); err != nil || len(cfg.Allowlist) != 2 {
+		t.Errorf("allowlist flag: %v, %v", cfg, err)
+	}
+}
+
+func TestAllowlistMixedRecords(t *testing.T) {
+	r := testRelay("0.0.0.0 mixed.example.com\n10.0.0.2 mixed.example.com\n")
+	r.pool = newUpstreamPool(nil, strategyFailover, 1)
+	r.cfg.Retries = 0
+
+	// blocked as long as it's not allowed, 0.0.0.0 wins
+	if m := testExchange(t, r, testQuery(1, "mixed.example.com")); m.Hdr.parseFlags().RCODE != 3 {
+		t.Errorf("not allowed: rcode %d, want 3", m.Hdr.parseFlags().RCODE)
+	}
+	// once allowed, the block record is dropped and the address is answered
+	r.allow = newAllowlist([]string{"mixed.example.com"})
+	m := testExchange(t, r, testQuery(2, "mixed.example.com"))
+	if rcode := m.Hdr.parseFlags().RCODE; rcode != 0 || len(m.Asr) != 1 || net.IP(m.Asr[0].RDATA).String() != "10.0.0.2" {
+		t.Errorf("allowed: rcode %d, answer %+v", rcode, m.Asr)
+	}
+	// and the hosts store is left as it is
+	if match, _ := r.hosts.current().match("mixed.example.com"); len(match.records) != 2 {
+		t.Errorf("hosts store changed: %+v", match.records)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"strings"
+)
+
+// block modes, how a name blocked by hosts is answered
+// nxdomain: RCODE(3) name error; nodata: NOERROR without answer; refused: RCODE(5);
+// null: 0.0.0.0 for A and :: for AAAA; sinkhole: addresses of cfg.Sinkhole
+const (
+	blockNXDomain = "nxdomain"
+	blockNoData   = "nodata"
+	blockRefused  = "refused"
+	blockNull     = "null"
+	blockSinkhole = "sinkhole"
+)
+
+// isBlockMode is a function to check whether mode is one of the block modes
+func isBlockMode(mode string) bool {
+	switch mode {
+	case blockNXDomain, blockNoData, blockRefused, blockNull, blockSinkhole:
+		return true
+	}
+	return false
+}
+
+// isBlockedIP is a function to check whether ip in hosts blocks a name by the global block mode,
+// 0.0.0.0 and :: (however it's written, such as ::0) are forbidden ip in DNS hosts, while 127.0.0.1 maps a name to localhost
+func isBlockedIP(ip string) bool {
+	return net.ParseIP(ip).IsUnspecified()
+}
+
+// blockModeOf is a function to tell whether records found in hosts block a name, and how
+// a record with a block mode in its address column (such as "refused ads.example.com") uses that mode,
+// while a record of 0.0.0.0 or :: uses global; the first blocking record wins
+func blockModeOf(records []hostsRecord, global string) (mode string, blocked bool) {
+	for _, record := range records {
+		if record.block != "" {
+			return record.block, true
+		}
+		if isBlockedIP(record.ip) {
+			return global, true
+		}
+	}
+	return "", false
+}
+
+// sinkholeRecord is a function to find a record of hosts blocking its name by sinkhole mode,
+// such a name gets NODATA unless sinkhole addresses are configured
+func (s *hostsStore) sinkholeRecord() (record hostsRecord, found bool) {
+	for _, records := range s.names {
+		for _, record := range records {
+			if record.block == blockSinkhole {
+				return record, true
+			}
+		}
+	}
+	return hostsRecord{}, false
+}
+
+// warnSinkhole is a function to log a warning if a rule of hosts (or of a blocklist) blocks by sinkhole mode without sinkhole addresses
+func warnSinkhole(hosts *hostsStore, sinkhole []string) {
+	if record, found := hosts.sinkholeRecord(); found && len(sinkhole) == 0 {
+		slog.Warn("sinkhole rule without sinkhole addresses, answered with NODATA", "path", record.path, "line", record.line)
+	}
+}
+
+// composeBlock is a function to generate a response to query (hdr, qst) for a name blocked by mode
+// sinkhole is addresses answered in sinkhole mode, a query of the other family gets NODATA
+func composeBlock(hdr DNSMsgHdr, qst DNSMsgQst, mode string, sinkhole []string, ttl uint32) []byte {
+	switch strings.ToLower(mode) {
+	case blockNoData:
+		return composeRcode(hdr, qst, 0)
+	case blockRefused:
+		return composeRcode(hdr, qst, 5)
+	case blockNull:
+		return composeAddrs(hdr, qst, []string{"0.0.0.0", "::"}, ttl)
+	case blockSinkhole:
+		return composeAddrs(hdr, qst, sinkhole, ttl)
+	default:
+		// RCODE(3) means name error, whatever QTYPE is
+		return composeRcode(hdr, qst, 3)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBlockModes(t *testing.T) {
+	hosts := "0.0.0.0 ads.example.com\n" +
+		":: tracker.example.com\n" +
+		"0:0:0:0:0:0:0:0 long.example.com\n" +
+		"::0 short.example.com\n" +
+		"127.0.0.1 localhost.example.com\n" +
+		"refused refused.example.com\n" +
+		"NODATA nodata.example.com\n" +
+		"null null.example.com\n" +
+		"nxdomain *.nx.example.com\n"
+	cases := []struct {
+		mode   string
+		name   string
+		qtype  uint16
+		rcode  uint8
+		answer []string
+	}{
+		// global mode for 0.0.0.0 and ::
+		{blockNXDomain, "ads.example.com", 1, 3, nil},
+		{blockNXDomain, "tracker.example.com", 28, 3, nil},
+		{blockNXDomain, "long.example.com", 28, 3, nil},
+		{blockNXDomain, "short.example.com", 1, 3, nil},
+		{blockNoData, "ads.example.com", 1, 0, nil},
+		{blockRefused, "ads.example.com", 1, 5, nil},
+		{blockNull, "ads.example.com", 1, 0, []string{"0.0.0.0"}},
+		{blockNull, "ads.example.com", 28, 0, []string{"::"}},
+		{blockSinkhole, "ads.example.com", 1, 0, []string{"10.0.0.53"}},
+		{blockSinkhole, "ads.example.com", 28, 0, nil},
+		// per-rule modes win over the global one
+		{blockNull, "refused.example.com", 1, 5, nil},
+		{blockNull, "nodata.example.com", 1, 0, nil},
+		{blockNull, "null.example.com", 1, 0, []string{"0.0.0.0"}},
+		{blockNull, "a.nx.example.com", 1, 3, nil},
+		// 127.0.0.1 is a legitimate mapping
+		{blockNXDomain, "localhost.example.com", 1, 0, []string{"127.0.0.1"}},
+	}
+	for _, c := range cases {
+		r := testRelay(hosts)
+		r.cfg.BlockMode = c.mode
+		r.cfg.Sinkhole = []string{"10.0.0.53"}
+		query := composeHdrQst(DNSMsgHdr{ID: 1, FLAGS: 0x0100, QDCOUNT: 1},
+			DNSMsgQst{QNAME: testQNAME(c.name), QTYPE: c.qtype, QCLASS: 1})
+		m := testExchange(t, r, query)
+		if rcode := m.Hdr.parseFlags().RCODE; rcode != c.rcode {
+			t.Errorf("%s (%s) type %d: rcode %d, want %d", c.name, c.mode, c.qtype, rcode, c.rcode)
+		}
+		var answer []string
+		for _, rr := range m.Asr {
+			answer = append(answer, net.IP(rr.RDATA).String())
+		}
+		if int(m.Hdr.ANCOUNT) != len(c.answer) || !reflect.DeepEqual(answer, c.answer) {
+			t.Errorf("%s (%s) type %d: answer %v, want %v", c.name, c.mode, c.qtype, answer, c.answer)
+		}
+	}
+}
+
+func TestSinkholeRecord(t *testing.T) {
+	entries, _, _ := parseHosts(strings.NewReader("0.0.0.0 ads.example.com\nsinkhole *.tracker.example.com\n"), "hosts")
+	record, found := newHostsStore(entries).sinkholeRecord()
+	if !found || record.path != "hosts" || record.line != 2 {
+		t.Errorf("sinkhole record %+v, found: %t", record, found)
+	}
+	entries, _, _ = parseHosts(strings.NewReader("0.0.0.0 ads.example.com\nrefused tracker.example.com\n"), "hosts")
+	if record, found := newHostsStore(entries).sinkholeRecord(); found {
+		t.Errorf("unexpected sinkhole record %+v", record)
+	}
+}
+
+func TestBlockModeConfig(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.BlockMode = "Sinkhole"
+	if err := cfg.validate(); err == nil {
+		t.Error("sinkhole mode without sinkhole addresses should be rejected")
+	}
+	cfg.Sinkhole = []string{"10.0.0.53", "not-an-ip"}
+	if err := cfg.validate(); err == nil {
+		t.Error("invalid sinkhole address should be rejected")
+	}
+	cfg.Sinkhole = []string{"10.0.0.53", "2001:db8::53"}
+	if err := cfg.validate(); err != nil || cfg.BlockMode != blockSinkhole {
+		t.Errorf("valid sinkhole config rejected: %v", err)
+	}
+	cfg.BlockMode = "drop"
+	if err := cfg.validate(); err == nil {
+		t.Error("unknown block mode should be rejected")
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// formats of blocklists
+// hosts: lines of /etc/hosts, every name listed is blocked, see parseHosts
+// domains: a domain name per line, '#' begins a comment
+// adblock: Adblock Plus rules, "||domain^" blocks domain and its subdomains, "@@||domain^" is an exception
+const (
+	formatHosts   = "hosts"
+	formatDomains = "domains"
+	formatAdblock = "adblock"
+)
+
+// Blocklist is a list of names to block, read from a local file
+// Path: path of the list; Format: "hosts", "domains" or "adblock"; Enabled: whether the list is loaded
+type Blocklist struct {
+	Path    string `json:"path"`
+	Format  string `json:"format"`
+	Enabled bool   `json:"enabled"`
+}
+
+// UnmarshalJSON is a function to read Blocklist, which is enabled unless "enabled" is false
+// unknown fields are rejected, as they are in the rest of config file
+func (l *Blocklist) UnmarshalJSON(b []byte) error {
+	// blocklist has no method of Blocklist, so decoding it won't call UnmarshalJSON again
+	type blocklist Blocklist
+	list := blocklist{Enabled: true}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&list); err != nil {
+		return err
+	}
+	*l = Blocklist(list)
+	return nil
+}
+
+// blocklistNames are names found in hosts-format blocklists which are not blocked,
+// such lists map them to loopback or broadcast addresses as /etc/hosts does
+var blocklistNames = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"0.0.0.0":               true,
+}
+
+// blockStore holds names of every blocklist
+// blocked: names blocked by the global block mode, unless they match allowed
+// allowed: exceptions of blocklists, such as "@@||domain^"
+type blockStore struct {
+	blocked *hostsStore
+	allowed *hostsStore
+}
+
+// match is a function to find the blocklist rule blocking name, an exception of any list wins
+// a nil blockStore blocks nothing
+func (s *blockStore) match(name string) (m hostsMatch, blocked bool) {
+	if s == nil {
+		return m, false
+	}
+	if _, allowed := s.allowed.match(name); allowed {
+		return m, false
+	}
+	return s.blocked.match(name)
+}
+
+// blocklistCount is the number of rules read from a blocklist
+type blocklistCount struct {
+	blocked int
+	allowed int
+	skipped int
+}
+
+// initBlocklists is a function to read every enabled blocklist into a block store,
+// names listed in more than one list are stored once; rules read from each list are logged,
+// malformed lines are skipped with warnings, while an enabled list which can't be read fails
+func initBlocklists(lists []Blocklist) (*blockStore, error) {
+	var blocked, allowed []hostsEntry
+	for _, list := range lists {
+		if !list.Enabled {
+			slog.Info("blocklist disabled", "path", list.Path)
+			continue
+		}
+		listBlocked, listAllowed, count, warnings, err := readBlocklist(list)
+		for _, warning := range warnings {
+			msg, attrs := lineWarning(warning)
+			slog.Warn(msg, attrs...)
+		}
+		if err != nil {
+			return nil, err
+		}
+		slog.Info("blocklist loaded", "path", list.Path, "format", list.Format,
+			"blocked", count.blocked, "exceptions", count.allowed, "unsupported", count.skipped)
+		blocked = append(blocked, listBlocked...)
+		allowed = append(allowed, listAllowed...)
+	}
+	s := &blockStore{blocked: newHostsStore(blocked), allowed: newHostsStore(allowed)}
+	if len(lists) > 0 {
+		slog.Info("blocklists loaded", "blocked", s.blocked.len(), "exceptions", s.allowed.len())
+	}
+	return s, nil
+}
+
+// readBlocklist is a function to read a single blocklist
+func readBlocklist(list Blocklist) (blocked, allowed []hostsEntry, count blocklistCount, warnings []string, err error) {
+	file, err := os.Open(list.Path)
+	if err != nil {
+		return nil, nil, count, nil, err
+	}
+	defer file.Close()
+	return parseBlocklist(file, list.Path, list.Format)
+}
+
+// parseBlocklist is a function to parse blocklist content of format read from rd
+// every blocked name is an entry of 0.0.0.0, answered by the global block mode,
+// unless a hosts-format list gives a block mode in its address column
+func parseBlocklist(rd io.Reader, path, format string) (blocked, allowed []hostsEntry, count blocklistCount, warnings []string, err error) {
+	switch format {
+	case formatDomains, formatAdblock:
+	case formatHosts:
+		var entries []hostsEntry
+		entries, warnings, err = parseHosts(rd, path)
+		for _, entry := range entries {
+			var names []string
+			for _, name := range entry.names {
+				if !blocklistNames[canonicalName(name)] {
+					names = append(names, name)
+				}
+			}
+			if len(names) == 0 {
+				continue
+			}
+			if entry.block == "" {
+				entry.ip = "0.0.0.0"
+			}
+			entry.names = names
+			blocked = append(blocked, entry)
+			count.blocked += len(names)
+		}
+		return
+	default:
+		return nil, nil, count, nil, fmt.Errorf("unknown format %q of blocklist %s", format, path)
+	}
+
+	scanner := bufio.NewScanner(rd)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		var name string
+		exception := false
+		switch format {
+		case formatDomains:
+			if i := strings.IndexByte(line, '#'); i >= 0 {
+				line = strings.TrimSpace(line[:i])
+			}
+			if line == "" {
+				continue
+			}
+			name = line
+		case formatAdblock:
+			// "!" begins a comment, "[Adblock Plus 2.0]" is a header
+			if line == "" || line[0] == '!' || line[0] == '[' {
+				continue
+			}
+			if strings.HasPrefix(line, "@@") {
+				exception, line = true, line[2:]
+			}
+			// only "||domain^" applies to DNS, rules of paths, options or element hiding don't
+			if !strings.HasPrefix(line, "||") || !strings.HasSuffix(line, "^") {
+				count.skipped++
+				continue
+			}
+			name = zonePrefix + line[2:len(line)-1]
+		}
+
+		if err := checkHostName(name); err != nil || strings.ContainsAny(name, " \t") {
+			warnings = append(warnings, fmt.Sprintf("%s:%d: invalid rule %q", path, lineNo, line))
+			continue
+		}
+		entry := hostsEntry{ip: "0.0.0.0", names: []string{strings.TrimSuffix(name, ".")}, path: path, line: lineNo}
+		if exception {
+			allowed = append(allowed, entry)
+			count.allowed++
+		} else {
+			blocked = append(blocked, entry)
+			count.blocked++
+		}
+	}
+	return blocked, allowed, count, warnings, scanner.Err()
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseBlocklist(t *testing.T) {
+	cases := []struct {
+		format   string
+		content  string
+		blocked  []string
+		allowed  []string
+		count    blocklistCount
+		warnings int
+	}{
+		{formatHosts, "127.0.0.1 localhost\n0.0.0.0 ads.example.com ads2.example.com # ad\n:: 0.0.0.0\n",
+			[]string{"ads.example.com", "ads2.example.com"}, nil, blocklistCount{blocked: 2}, 0},
+		{formatDomains, "# tracking\ntracker.example.com\n  metrics.example.com # inline\n\nbad..example.com\n",
+			[]string{"tracker.example.com", "metrics.example.com"}, nil, blocklistCount{blocked: 2}, 1},
+		{formatAdblock, "[Adblock Plus 2.0]\n! comment\n||ads.example.com^\n@@||good.ads.example.com^\n" +
+			"||ads.example.com^$third-party\n/banner/*\nexample.com##.ad\n||^\n",
+			[]string{".ads.example.com"}, []string{".good.ads.example.com"}, blocklistCount{blocked: 1, allowed: 1, skipped: 3}, 1},
+	}
+	for _, c := range cases {
+		blocked, allowed, count, warnings, err := parseBlocklist(strings.NewReader(c.content), "test", c.format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, entry := range blocked {
+			names = append(names, entry.names...)
+		}
+		if strings.Join(names, ",") != strings.Join(c.blocked, ",") {
+			t.Errorf("%s: blocked %v, want %v", c.format, names, c.blocked)
+		}
+		names = nil
+		for _, entry := range allowed {
+			names = append(names, entry.names...)
+		}
+		if strings.Join(names, ",") != strings.Join(c.allowed, ",") {
+			t.Errorf("%s: allowed %v, want %v", c.format, names, c.allowed)
+		}
+		if count != c.count || len(warnings) != c.warnings {
+			t.Errorf("%s: count %+v with warnings %q", c.format, count, warnings)
+		}
+	}
+	if _, _, _, _, err := parseBlocklist(strings.NewReader(""), "test", "json"); err == nil {
+		t.Error("unknown format should fail")
+	}
+}
+
+func TestBlocklists(t *testing.T) {
+	lists := []Blocklist{
+		{Path: testHostsFile(t, "0.0.0.0 ads.example.com\n0.0.0.0 shared.example.com\n"), Format: formatHosts, Enabled: true},
+		{Path: testHostsFile(t, "shared.example.com\nSHARED.example.com.\n"), Format: formatDomains, Enabled: true},
+		{Path: testHostsFile(t, "||tracker.example.com^\n@@||cdn.tracker.example.com^\n"), Format: formatAdblock, Enabled: true},
+		{Path: testHostsFile(t, "disabled.example.com\n"), Format: formatDomains},
+	}
+	blocks, err := initBlocklists(lists)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blocks.blocked.len() != 3 || len(blocks.blocked.lookup("shared.example.com")) != 1 {
+		t.Errorf("names of blocklists are not deduplicated: %d names", blocks.blocked.len())
+	}
+
+	r := testRelay("10.0.0.1 ads.example.com\n")
+	r.blocks = blocks
+	// names not blocked go to remote DNS, which is absent here
+	r.pool = newUpstreamPool(nil, strategyFailover, 1)
+	r.cfg.Retries = 0
+	cases := []struct {
+		name  string
+		rcode uint8
+	}{
+		// hosts files come first
+		{"ads.example.com", 0},
+		{"shared.example.com", 3},
+		{"tracker.example.com", 3},
+		{"a.tracker.example.com", 3},
+		{"x.cdn.tracker.example.com", 2},
+		{"disabled.example.com", 2},
+	}
+	for _, c := range cases {
+		m := testExchange(t, r, testQuery(1, c.name))
+		if rcode := m.Hdr.parseFlags().RCODE; rcode != c.rcode {
+			t.Errorf("%s: rcode %d, want %d", c.name, rcode, c.rcode)
+		}
+	}
+
+	lists[0].Path = filepath.Join(t.TempDir(), "missing")
+	if _, err = initBlocklists(lists); err == nil {
+		t.Error("an enabled blocklist which can't be read should fail")
+	}
+	lists[0].Enabled = false
+	if _, err = initBlocklists(lists); err != nil {
+		t.Errorf("a disabled blocklist which can't be read should be ignored, got %v", err)
+	}
+}
+
+func TestBlocklistConfig(t *testing.T) {
+	path := testConfigFile(t, `{"blocklists": [
+		{"path": "easylist.txt", "format": "Adblock"},
+		{"path": "hosts.txt", "format": "hosts", "enabled": false}
+	]}`)
+	cfg, err := loadConfig([]string{"-config", path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Blocklists) != 2 || !cfg.Blocklists[0].Enabled || cfg.Blocklists[0].Format != formatAdblock || cfg.Blocklists[1].Enabled {
+		t.Errorf("blocklists are %+v", cfg.Blocklists)
+	}
+	for _, content := range []string{
+		`{"blocklists": [{"path": "a.txt", "format": "json"}]}`,
+		`{"blocklists": [{"format": "hosts"}]}`,
+		`{"blocklists": [{"path": "a.txt", "format": "hosts", "enable": true}]}`,
+	} {
+		if _, err := loadConfig([]string{"-config", testConfigFile(t, content)}); err == nil {
+			t.Errorf("config %s should be rejected", content)
+		}
+	}
+}
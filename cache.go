@@ -0,0 +1,233 @@
+package main
+
+import (
+	"container/list"
+	"encoding/binary"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultCacheSize is the number of answers kept by answerCache
+const defaultCacheSize = 4096
+
+// defaultMaxNegativeTTL caps how long (second) NXDOMAIN/NODATA is cached, 3 hours as RFC-2308 suggests
+const defaultMaxNegativeTTL = 10800
+
+// cacheKey identifies a cached answer by (QNAME, QTYPE, QCLASS), and by DO and CD of the query,
+// which are forwarded to remote DNS and change its answer: RRSIGs are only sent to DO queries,
+// and unvalidated data only to CD queries, so answers to other queries are never shared with them
+type cacheKey struct {
+	qname  string
+	qtype  uint16
+	qclass uint16
+	do     bool
+	cd     bool
+}
+
+// newCacheKey build the key of a query, QNAME is case-insensitive, opt is nil without EDNS(0)
+func newCacheKey(hdr DNSMsgHdr, qst DNSMsgQst, opt *DNSMsgOPT) cacheKey {
+	return cacheKey{
+		qname:  strings.ToLower(string(qst.QNAME)),
+		qtype:  qst.QTYPE,
+		qclass: qst.QCLASS,
+		do:     opt != nil && opt.DO,
+		cd:     hdr.parseFlags().CD == 1,
+	}
+}
+
+// cacheEntry is an answer from remote DNS remembered by answerCache
+// negative entry is a NXDOMAIN/NODATA reply whose SOA RR is kept to build the answer again
+// msg is the whole reply, packed again with the ID and question of each query it answers
+type cacheEntry struct {
+	key      cacheKey
+	msg      DNSMsg
+	negative bool
+	storedAt time.Time
+	expireAt time.Time
+}
+
+// answerCache is a LRU cache of answers from remote DNS shared by all handler goroutines
+// entries expire once the smallest TTL among their RRs runs out
+type answerCache struct {
+	mtx            sync.Mutex
+	capacity       int
+	maxNegativeTTL uint32
+	ll             *list.List
+	entries        map[cacheKey]*list.Element
+	now            func() time.Time
+}
+
+// newAnswerCache is a function to create answerCache holding capacity answers at most,
+// NXDOMAIN/NODATA answers are cached for maxNegativeTTL seconds at most
+func newAnswerCache(capacity int, maxNegativeTTL uint32) *answerCache {
+	return &answerCache{
+		capacity:       capacity,
+		maxNegativeTTL: maxNegativeTTL,
+		ll:             list.New(),
+		entries:        make(map[cacheKey]*list.Element),
+		now:            time.Now,
+	}
+}
+
+// minTTL is a function to get the smallest TTL among RRs of all sections, 0 if there's no RR
+func minTTL(m DNSMsg) (ttl uint32) {
+	first := true
+	for _, rr := range m.allRRs() {
+		// TTL of OPT pseudo-RR(41) holds flags instead of time to live
+		if rr.TYPE == 41 {
+			continue
+		}
+		if first || rr.TTL < ttl {
+			ttl, first = rr.TTL, false
+		}
+	}
+	return
+}
+
+// soaMinimum is a function to draw MINIMUM field from RDATA of a SOA RR
+// MINIMUM is the last 32 bits of RDATA, behind MNAME, RNAME, SERIAL, REFRESH, RETRY and EXPIRE
+func soaMinimum(soa DNSMsgRR) uint32 {
+	if len(soa.RDATA) < 20 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(soa.RDATA[len(soa.RDATA)-4:])
+}
+
+// negativeSOA is a function to find index of SOA RR(6) in authority section of a reply
+func negativeSOA(m DNSMsg) (index int, ok bool) {
+	for i, rr := range m.Ns {
+		if rr.TYPE == 6 {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// cacheableTTL is a function to decide how long a reply can be cached
+// only complete (TC cleared) replies to a single question are cached:
+//
+//	positive: NOERROR with answers, cached for the smallest TTL among RRs
+//	negative: NXDOMAIN, or NOERROR without answers(NODATA), per RFC-2308
+//	          cached for min(SOA TTL, SOA MINIMUM, maxNegativeTTL), and not cached without SOA
+//
+// 0 means the reply is not cacheable
+func cacheableTTL(m DNSMsg, maxNegativeTTL uint32) (ttl uint32, negative bool) {
+	flags := m.Hdr.parseFlags()
+	if flags.QR != 1 || flags.TC != 0 || len(m.Qst) != 1 {
+		return 0, false
+	}
+	switch {
+	case flags.RCODE == 0 && len(m.Asr) > 0:
+		return minTTL(m), false
+	case flags.RCODE == 3 || flags.RCODE == 0:
+		i, ok := negativeSOA(m)
+		if !ok {
+			return 0, false
+		}
+		ttl = minTTL(m)
+		if min := soaMinimum(m.Ns[i]); min < ttl {
+			ttl = min
+		}
+		if ttl > maxNegativeTTL {
+			ttl = maxNegativeTTL
+		}
+		return ttl, true
+	}
+	return 0, false
+}
+
+// put is a function to remember a reply from remote DNS for the query (hdr, qst, opt)
+func (c *answerCache) put(hdr DNSMsgHdr, qst DNSMsgQst, opt *DNSMsgOPT, resp []byte) {
+	if c.capacity <= 0 {
+		return
+	}
+	m, err := unpackDNSMsg(resp)
+	if err != nil {
+		return
+	}
+	ttl, negative := cacheableTTL(m, c.maxNegativeTTL)
+	if ttl == 0 {
+		return
+	}
+
+	// OPT is hop-by-hop, every response gets its own, see replyOPT
+	m.Add = withoutOPT(m.Add)
+	// TTL of SOA in a negative answer should not exceed the negative caching time
+	if i, ok := negativeSOA(m); negative && ok && m.Ns[i].TTL > ttl {
+		m.Ns[i].TTL = ttl
+	}
+	now := c.now()
+	entry := &cacheEntry{
+		key:      newCacheKey(hdr, qst, opt),
+		msg:      m,
+		negative: negative,
+		storedAt: now,
+		expireAt: now.Add(time.Duration(ttl) * time.Second),
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if elem, ok := c.entries[entry.key]; ok {
+		elem.Value = entry
+		c.ll.MoveToFront(elem)
+		return
+	}
+	c.entries[entry.key] = c.ll.PushFront(entry)
+	for c.ll.Len() > c.capacity {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// get is a function to answer the query (hdr, qst, opt) from cache
+// TTL of every RR is counted down by the time the answer has stayed in cache,
+// negative reports whether the answer is a cached NXDOMAIN/NODATA
+func (c *answerCache) get(hdr DNSMsgHdr, qst DNSMsgQst, opt *DNSMsgOPT) (resp []byte, negative bool, ok bool) {
+	key := newCacheKey(hdr, qst, opt)
+	now := c.now()
+
+	c.mtx.Lock()
+	elem, ok := c.entries[key]
+	if !ok {
+		c.mtx.Unlock()
+		return nil, false, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if !now.Before(entry.expireAt) {
+		c.ll.Remove(elem)
+		delete(c.entries, key)
+		c.mtx.Unlock()
+		return nil, false, false
+	}
+	c.ll.MoveToFront(elem)
+	c.mtx.Unlock()
+
+	// entry.msg is shared, RRs are copied before TTLs are counted down
+	elapsed := uint32(now.Sub(entry.storedAt) / time.Second)
+	m := DNSMsg{Hdr: entry.msg.Hdr, Qst: []DNSMsgQst{qst}}
+	m.Hdr.ID = hdr.ID
+	m.Asr = countDownTTL(entry.msg.Asr, elapsed)
+	m.Ns = countDownTTL(entry.msg.Ns, elapsed)
+	m.Add = countDownTTL(entry.msg.Add, elapsed)
+	return packDNSMsg(m), entry.negative, true
+}
+
+// countDownTTL is a function to copy rrs with TTL decreased by elapsed seconds
+func countDownTTL(rrs []DNSMsgRR, elapsed uint32) (counted []DNSMsgRR) {
+	for _, rr := range rrs {
+		if rr.TYPE != 41 {
+			rr.TTL -= elapsed
+		}
+		counted = append(counted, rr)
+	}
+	return
+}
+
+// len is a function to get the number of answers in cache
+func (c *answerCache) len() int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.ll.Len()
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testResponse compose a reply of domainName carrying A records with given TTLs
+func testResponse(id uint16, domainName string, ttls ...uint32) (hdr DNSMsgHdr, qst DNSMsgQst, resp []byte) {
+	hdr = DNSMsgHdr{ID: id, FLAGS: 0x8180, QDCOUNT: 1, ANCOUNT: uint16(len(ttls))}
+	qst = DNSMsgQst{QNAME: testQNAME(domainName), QTYPE: 1, QCLASS: 1}
+	resp = composeHdrQst(hdr, qst)
+	for i, ttl := range ttls {
+		asr := createDNSMsgAsr(1, 1, ttl, 4, "10.0.0."+strconv.Itoa(i+1))
+		resp = append(resp, composeRR(asr)...)
+	}
+	return
+}
+
+// testClock is a fake clock for answerCache
+type testClock struct{ t time.Time }
+
+func (c *testClock) now() time.Time { return c.t }
+
+func TestAnswerCacheTTL(t *testing.T) {
+	clock := &testClock{t: time.Unix(1600000000, 0)}
+	cache := newAnswerCache(16, defaultMaxNegativeTTL)
+	cache.now = clock.now
+
+	_, qst, resp := testResponse(0x1234, "www.ljg.top", 60, 30)
+	cache.put(DNSMsgHdr{}, qst, nil, resp)
+
+	clock.t = clock.t.Add(10 * time.Second)
+	query := DNSMsgHdr{ID: 0xabcd, FLAGS: 0x0100, QDCOUNT: 1}
+	cached, _, ok := cache.get(query, qst, nil)
+	if !ok {
+		t.Fatal("answer not found in cache")
+	}
+	hdr, rrs := testUnpack(t, cached)
+	if hdr.ID != 0xabcd {
+		t.Errorf("cached answer ID is %#x, want %#x", hdr.ID, 0xabcd)
+	}
+	if len(rrs) != 2 || rrs[0].TTL != 50 || rrs[1].TTL != 20 {
+		t.Errorf("cached answer RRs are %v, want TTL 50 and 20", rrs)
+	}
+
+	clock.t = clock.t.Add(20 * time.Second)
+	if _, _, ok := cache.get(query, qst, nil); ok {
+		t.Error("answer should expire with its smallest TTL")
+	}
+	if cache.len() != 0 {
+		t.Errorf("expired answer still in cache")
+	}
+}
+
+func TestAnswerCacheCaseInsensitive(t *testing.T) {
+	cache := newAnswerCache(16, defaultMaxNegativeTTL)
+	_, qst, resp := testResponse(1, "www.ljg.top", 60)
+	cache.put(DNSMsgHdr{}, qst, nil, resp)
+
+	upper := DNSMsgQst{QNAME: testQNAME("WWW.Ljg.TOP"), QTYPE: 1, QCLASS: 1}
+	if _, _, ok := cache.get(DNSMsgHdr{ID: 2}, upper, nil); !ok {
+		t.Error("QNAME should be compared case-insensitively")
+	}
+	aaaa := DNSMsgQst{QNAME: testQNAME("www.ljg.top"), QTYPE: 28, QCLASS: 1}
+	if _, _, ok := cache.get(DNSMsgHdr{ID: 2}, aaaa, nil); ok {
+		t.Error("answer of QTYPE A should not be used for QTYPE AAAA")
+	}
+}
+
+func TestAnswerCacheLRU(t *testing.T) {
+	cache := newAnswerCache(2, defaultMaxNegativeTTL)
+	_, qst1, resp1 := testResponse(1, "a.example", 60)
+	_, qst2, resp2 := testResponse(2, "b.example", 60)
+	_, qst3, resp3 := testResponse(3, "c.example", 60)
+	cache.put(DNSMsgHdr{}, qst1, nil, resp1)
+	cache.put(DNSMsgHdr{}, qst2, nil, resp2)
+	// touch a.example, so that b.example is the least recently used
+	cache.get(DNSMsgHdr{}, qst1, nil)
+	cache.put(DNSMsgHdr{}, qst3, nil, resp3)
+
+	if _, _, ok := cache.get(DNSMsgHdr{}, qst2, nil); ok {
+		t.Error("least recently used answer should be evicted")
+	}
+	for _, qst := range []DNSMsgQst{qst1, qst3} {
+		if _, _, ok := cache.get(DNSMsgHdr{}, qst, nil); !ok {
+			t.Errorf("answer of %s should be kept", qst.parseDomainName())
+		}
+	}
+}
+
+func TestAnswerCacheUncacheable(t *testing.T) {
+	cache := newAnswerCache(16, defaultMaxNegativeTTL)
+	_, qst, resp := testResponse(1, "www.ljg.top", 60)
+	// TC set
+	resp[2] |= 0x02
+	cache.put(DNSMsgHdr{}, qst, nil, resp)
+	// TTL 0
+	_, qst0, resp0 := testResponse(1, "zero.ljg.top", 0)
+	cache.put(DNSMsgHdr{}, qst0, nil, resp0)
+	if cache.len() != 0 {
+		t.Error("truncated answer and answer with TTL 0 should not be cached")
+	}
+}
+
+// testNegativeResponse compose a NXDOMAIN(rcode 3) or NODATA(rcode 0) reply,
+// carrying a SOA RR with TTL soaTTL and MINIMUM soaMin if withSOA is set
+func testNegativeResponse(domainName string, rcode uint16, withSOA bool, soaTTL, soaMin uint32) (qst DNSMsgQst, resp []byte) {
+	hdr := DNSMsgHdr{ID: 1, FLAGS: 0x8180 | rcode, QDCOUNT: 1}
+	if withSOA {
+		hdr.NSCOUNT = 1
+	}
+	qst = DNSMsgQst{QNAME: testQNAME(domainName), QTYPE: 1, QCLASS: 1}
+	resp = composeHdrQst(hdr, qst)
+	if withSOA {
+		rdata := append(testQNAME("ns.example"), testQNAME("admin.example")...)
+		for _, v := range []uint32{2021021901, 7200, 3600, 1209600, soaMin} {
+			field := make([]byte, 4)
+			binary.BigEndian.PutUint32(field, v)
+			rdata = append(rdata, field...)
+		}
+		soa := DNSMsgRR{
+			NAME: testQNAME("example"), TYPE: 6, CLASS: 1, TTL: soaTTL,
+			RDLENGTH: uint16(len(rdata)), RDATA: rdata,
+		}
+		resp = append(resp, composeRR(soa)...)
+	}
+	return
+}
+
+func TestAnswerCacheNegative(t *testing.T) {
+	for _, rcode := range []uint16{3, 0} {
+		clock := &testClock{t: time.Unix(1600000000, 0)}
+		cache := newAnswerCache(16, defaultMaxNegativeTTL)
+		cache.now = clock.now
+
+		qst, resp := testNegativeResponse("typo.example", rcode, true, 3600, 300)
+		cache.put(DNSMsgHdr{}, qst, nil, resp)
+
+		clock.t = clock.t.Add(100 * time.Second)
+		cached, negative, ok := cache.get(DNSMsgHdr{ID: 7}, qst, nil)
+		if !ok || !negative {
+			t.Fatalf("rcode %d: negative answer not found in cache", rcode)
+		}
+		hdr, rrs := testUnpack(t, cached)
+		if flags := hdr.parseFlags(); flags.RCODE != uint8(rcode) {
+			t.Errorf("rcode %d: cached answer has rcode %d", rcode, flags.RCODE)
+		}
+		if hdr.ANCOUNT != 0 || hdr.NSCOUNT != 1 || len(rrs) != 1 || rrs[0].TYPE != 6 {
+			t.Fatalf("rcode %d: cached answer should carry the SOA only, got %v", rcode, rrs)
+		}
+		// min(SOA TTL 3600, MINIMUM 300) - 100
+		if rrs[0].TTL != 200 {
+			t.Errorf("rcode %d: SOA TTL is %d, want 200", rcode, rrs[0].TTL)
+		}
+		if soaMinimum(rrs[0]) != 300 {
+			t.Errorf("rcode %d: SOA RDATA is changed", rcode)
+		}
+
+		clock.t = clock.t.Add(200 * time.Second)
+		if _, _, ok := cache.get(DNSMsgHdr{ID: 7}, qst, nil); ok {
+			t.Errorf("rcode %d: negative answer should expire with SOA MINIMUM", rcode)
+		}
+	}
+}
+
+func TestAnswerCacheNegativeWithoutSOA(t *testing.T) {
+	cache := newAnswerCache(16, defaultMaxNegativeTTL)
+	qst, resp := testNegativeResponse("typo.example", 3, false, 0, 0)
+	cache.put(DNSMsgHdr{}, qst, nil, resp)
+	if cache.len() != 0 {
+		t.Error("negative answer without SOA should not be cached")
+	}
+}
+
+func TestHandlerCacheDNSSEC(t *testing.T) {
+	// remote DNS answers every query with an A record of TTL 60, and counts them
+	queries := new(int32)
+	addr := testFakeDNS(t, func(query []byte) []byte {
+		atomic.AddInt32(queries, 1)
+		hdr, qst, _, err := parseDNSRequest(query)
+		if err != nil {
+			return nil
+		}
+		_, _, resp := testResponse(hdr.ID, qst.parseDomainName(), 60)
+		return resp
+	})
+	r := testRelay("")
+	r.pool = newUpstreamPool([]*upstream{newUpstream("test", testMux(t, addr))}, strategyFailover, 3)
+
+	cd := testQuery(1, "www.ljg.top")
+	cd[3] |= 0x10
+	cases := []struct {
+		query   []byte
+		queries int32
+	}{
+		{testQuery(1, "www.ljg.top"), 1},
+		{testQuery(2, "www.ljg.top"), 1},
+		// answers to queries without DO lack RRSIGs, a validating client must not get them
+		{testEDNSQuery(3, "www.ljg.top", DNSMsgOPT{UDPSize: 1232, DO: true}), 2},
+		{testEDNSQuery(4, "www.ljg.top", DNSMsgOPT{UDPSize: 1232, DO: true}), 2},
+		{testEDNSQuery(5, "www.ljg.top", DNSMsgOPT{UDPSize: 1232}), 2},
+		{cd, 3},
+	}
+	client, server := net.Pipe()
+	defer client.Close()
+	go r.serveTCPConn(server)
+	client.SetDeadline(time.Now().Add(time.Second))
+	for i, c := range cases {
+		if err := writeTCPMsg(client, c.query); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readTCPMsg(client); err != nil {
+			t.Fatal(err)
+		}
+		if got := atomic.LoadInt32(queries); got != c.queries {
+			t.Errorf("query %d: remote DNS got %d queries, want %d", i+1, got, c.queries)
+		}
+	}
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+// DNSMsg is a struct of a whole DNS MESSAGE
+// from RFC-1035
+// +---------------------+
+// |        Header       |
+// +---------------------+
+// |       Question      | the question for the name server
+// +---------------------+
+// |        Answer       | RRs answering the question
+// +---------------------+
+// |      Authority      | RRs pointing toward an authority
+// +---------------------+
+// |      Additional     | RRs holding additional information
+// +---------------------+
+// all domain names (QNAME, NAME, and names inside RDATA) are kept uncompressed,
+// unpackDNSMsg follows compression pointers and packDNSMsg emits them again
+type DNSMsg struct {
+	Hdr DNSMsgHdr
+	Qst []DNSMsgQst
+	Asr []DNSMsgRR
+	Ns  []DNSMsgRR
+	Add []DNSMsgRR
+}
+
+// maxLabelLen and maxNameLen are limits of label and domain name from RFC-1035
+// minUDPSize is the size of UDP message every client accepts, RFC-1035 2.3.4
+// maxUDPSize is the largest message a UDP datagram can carry
+const (
+	maxLabelLen = 63
+	maxNameLen  = 255
+	minUDPSize  = 512
+	maxUDPSize  = 65535
+)
+
+var (
+	errShortMsg    = errors.New("DNS message too short")
+	errBadPointer  = errors.New("DNS message has bad compression pointer")
+	errBadLabel    = errors.New("DNS message has bad label type")
+	errLongName    = errors.New("DNS message has domain name over 255 octets")
+	errNoQuestion  = errors.New("DNS message has no question")
+	errTrailingMsg = errors.New("DNS message has trailing octets")
+)
+
+// rdataNames describes where domain names live in RDATA of a RR TYPE
+// prefix: octets before the first name; names: number of consecutive names;
+// compress: whether names may be compressed when packing (only types from RFC-1035, see RFC-3597)
+type rdataNames struct {
+	prefix   int
+	names    int
+	compress bool
+}
+
+// rdataLayouts is RR TYPEs whose RDATA contains domain names
+var rdataLayouts = map[uint16]rdataNames{
+	2:  {0, 1, true},  // NS
+	3:  {0, 1, true},  // MD
+	4:  {0, 1, true},  // MF
+	5:  {0, 1, true},  // CNAME
+	6:  {0, 2, true},  // SOA: MNAME, RNAME, then SERIAL..MINIMUM
+	7:  {0, 1, true},  // MB
+	8:  {0, 1, true},  // MG
+	9:  {0, 1, true},  // MR
+	12: {0, 1, true},  // PTR
+	14: {0, 2, true},  // MINFO
+	15: {2, 1, true},  // MX: PREFERENCE, EXCHANGE
+	17: {0, 2, false}, // RP
+	18: {2, 1, false}, // AFSDB
+	21: {2, 1, false}, // RT
+	26: {2, 2, false}, // PX
+	33: {6, 1, false}, // SRV: PRIORITY, WEIGHT, PORT, TARGET
+	36: {2, 1, false}, // KX
+	39: {0, 1, false}, // DNAME
+}
+
+// unpackName is a function to draw a domain name beginning at msg[offset:]
+// compression pointers are followed, name is returned uncompressed, such as
+// 06 google 03 com 00, and next is the offset right behind the name in msg
+// a pointer has to point before itself and before every pointer followed so far,
+// so pointer loops are errors, as well as names over 255 octets
+func unpackName(msg []byte, offset int) (name []byte, next int, err error) {
+	i := offset
+	// limit is the offset a pointer has to point before, so pointers never go around in circles
+	limit := offset
+	jumped := false
+	for {
+		if i >= len(msg) {
+			return nil, 0, errShortMsg
+		}
+		c := int(msg[i])
+		switch c & 0xc0 {
+		case 0x00:
+			if c == 0 {
+				name = append(name, 0x00)
+				if !jumped {
+					next = i + 1
+				}
+				return name, next, nil
+			}
+			if i+1+c > len(msg) {
+				return nil, 0, errShortMsg
+			}
+			name = append(name, msg[i:i+1+c]...)
+			// the root label 00 is not appended yet
+			if len(name)+1 > maxNameLen {
+				return nil, 0, errLongName
+			}
+			i += 1 + c
+		case 0xc0:
+			if i+2 > len(msg) {
+				return nil, 0, errShortMsg
+			}
+			ptr := int(binary.BigEndian.Uint16(msg[i:i+2]) & 0x3fff)
+			if ptr >= limit {
+				return nil, 0, errBadPointer
+			}
+			if !jumped {
+				next = i + 2
+				jumped = true
+			}
+			limit = ptr
+			i = ptr
+		default:
+			// 0x40 and 0x80 are extended and reserved label types, or a label over 63 octets
+			return nil, 0, errBadLabel
+		}
+	}
+}
+
+// unpackQst is a function to draw a question beginning at msg[offset:]
+func unpackQst(msg []byte, offset int) (qst DNSMsgQst, next int, err error) {
+	qst.QNAME, next, err = unpackName(msg, offset)
+	if err != nil {
+		return
+	}
+	if next+4 > len(msg) {
+		return qst, 0, errShortMsg
+	}
+	qst.QTYPE = binary.BigEndian.Uint16(msg[next : next+2])
+	qst.QCLASS = binary.BigEndian.Uint16(msg[next+2 : next+4])
+	return qst, next + 4, nil
+}
+
+// unpackRR is a function to draw a Resource Record beginning at msg[offset:]
+// names inside RDATA of types in rdataLayouts are decompressed, and RDLENGTH is updated
+func unpackRR(msg []byte, offset int) (rr DNSMsgRR, next int, err error) {
+	rr.NAME, next, err = unpackName(msg, offset)
+	if err != nil {
+		return
+	}
+	if next+10 > len(msg) {
+		return rr, 0, errShortMsg
+	}
+	rr.TYPE = binary.BigEndian.Uint16(msg[next : next+2])
+	rr.CLASS = binary.BigEndian.Uint16(msg[next+2 : next+4])
+	rr.TTL = binary.BigEndian.Uint32(msg[next+4 : next+8])
+	rr.RDLENGTH = binary.BigEndian.Uint16(msg[next+8 : next+10])
+	begin := next + 10
+	end := begin + int(rr.RDLENGTH)
+	if end > len(msg) {
+		return rr, 0, errShortMsg
+	}
+
+	layout, ok := rdataLayouts[rr.TYPE]
+	if !ok {
+		rr.RDATA = append([]byte(nil), msg[begin:end]...)
+		return rr, end, nil
+	}
+	if begin+layout.prefix > end {
+		return rr, 0, errShortMsg
+	}
+	rdata := append([]byte(nil), msg[begin:begin+layout.prefix]...)
+	i := begin + layout.prefix
+	for n := 0; n < layout.names; n++ {
+		var name []byte
+		if name, i, err = unpackName(msg[:end], i); err != nil {
+			return rr, 0, err
+		}
+		rdata = append(rdata, name...)
+	}
+	rr.RDATA = append(rdata, msg[i:end]...)
+	rr.RDLENGTH = uint16(len(rr.RDATA))
+	return rr, end, nil
+}
+
+// unpackDNSMsg is a function to translate octet-stream into struct DNSMsg
+// msg has to end right behind the last RR of additional section
+func unpackDNSMsg(msg []byte) (m DNSMsg, err error) {
+	if m.Hdr, err = parseDNSHdr(msg); err != nil {
+		return
+	}
+	offset := 12
+	for i := 0; i < int(m.Hdr.QDCOUNT); i++ {
+		var qst DNSMsgQst
+		if qst, offset, err = unpackQst(msg, offset); err != nil {
+			return
+		}
+		m.Qst = append(m.Qst, qst)
+	}
+	sections := []struct {
+		count int
+		rrs   *[]DNSMsgRR
+	}{
+		{int(m.Hdr.ANCOUNT), &m.Asr},
+		{int(m.Hdr.NSCOUNT), &m.Ns},
+		{int(m.Hdr.ARCOUNT), &m.Add},
+	}
+	for _, section := range sections {
+		for i := 0; i < section.count; i++ {
+			var rr DNSMsgRR
+			if rr, offset, err = unpackRR(msg, offset); err != nil {
+				return
+			}
+			*section.rrs = append(*section.rrs, rr)
+		}
+	}
+	if offset != len(msg) {
+		return m, errTrailingMsg
+	}
+	return m, nil
+}
+
+// compressor remembers offsets of names already packed into a message
+// keys are lowercase uncompressed names, since domain names are case-insensitive
+type compressor map[string]int
+
+// packName is a function to append domain name to msg, compressed by c if c is not nil
+// name is uncompressed normally, but a name ending with a pointer (such as C0 0C
+// from createDNSMsgAsr) is also accepted and copied as it is
+func packName(msg []byte, name []byte, c compressor) []byte {
+	for i := 0; i < len(name); {
+		l := int(name[i])
+		if l == 0 || l&0xc0 == 0xc0 || i+1+l > len(name) {
+			return append(msg, name[i:]...)
+		}
+		if c != nil {
+			key := strings.ToLower(string(name[i:]))
+			if ptr, ok := c[key]; ok {
+				return append(msg, byte(0xc0|ptr>>8), byte(ptr))
+			}
+			// a pointer has only 14 bits for offset
+			if len(msg) <= 0x3fff {
+				c[key] = len(msg)
+			}
+		}
+		msg = append(msg, name[i:i+1+l]...)
+		i += 1 + l
+	}
+	return msg
+}
+
+// packRR is a function to append rr to msg, recomputing RDLENGTH
+func packRR(msg []byte, rr DNSMsgRR, c compressor) []byte {
+	msg = packName(msg, rr.NAME, c)
+	fixed := make([]byte, 10)
+	binary.BigEndian.PutUint16(fixed[0:2], rr.TYPE)
+	binary.BigEndian.PutUint16(fixed[2:4], rr.CLASS)
+	binary.BigEndian.PutUint32(fixed[4:8], rr.TTL)
+	msg = append(msg, fixed...)
+	lengthAt := len(msg) - 2
+
+	layout, ok := rdataLayouts[rr.TYPE]
+	if !ok || len(rr.RDATA) < layout.prefix {
+		msg = append(msg, rr.RDATA...)
+	} else {
+		rdataCompressor := c
+		if !layout.compress {
+			rdataCompressor = nil
+		}
+		msg = append(msg, rr.RDATA[:layout.prefix]...)
+		i := layout.prefix
+		for n := 0; n < layout.names && i < len(rr.RDATA); n++ {
+			end := nameEnd(rr.RDATA, i)
+			msg = packName(msg, rr.RDATA[i:end], rdataCompressor)
+			i = end
+		}
+		msg = append(msg, rr.RDATA[i:]...)
+	}
+	binary.BigEndian.PutUint16(msg[lengthAt:], uint16(len(msg)-lengthAt-2))
+	return msg
+}
+
+// nameEnd is a function to find the offset right behind an uncompressed name beginning at b[i:]
+func nameEnd(b []byte, i int) int {
+	for i < len(b) {
+		l := int(b[i])
+		if l == 0 {
+			return i + 1
+		}
+		if l&0xc0 == 0xc0 {
+			return i + 2
+		}
+		i += 1 + l
+	}
+	return len(b)
+}
+
+// packDNSMsg is a function to translate struct DNSMsg into octet-stream
+// header counts are taken from the length of each section, and names are compressed
+func packDNSMsg(m DNSMsg) (msg []byte) {
+	hdr := m.Hdr
+	hdr.QDCOUNT = uint16(len(m.Qst))
+	hdr.ANCOUNT = uint16(len(m.Asr))
+	hdr.NSCOUNT = uint16(len(m.Ns))
+	hdr.ARCOUNT = uint16(len(m.Add))
+	msg = make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(msg[0:2], hdr.ID)
+	binary.BigEndian.PutUint16(msg[2:4], hdr.FLAGS)
+	binary.BigEndian.PutUint16(msg[4:6], hdr.QDCOUNT)
+	binary.BigEndian.PutUint16(msg[6:8], hdr.ANCOUNT)
+	binary.BigEndian.PutUint16(msg[8:10], hdr.NSCOUNT)
+	binary.BigEndian.PutUint16(msg[10:12], hdr.ARCOUNT)
+
+	c := compressor{}
+	for _, qst := range m.Qst {
+		msg = packName(msg, qst.QNAME, c)
+		fixed := make([]byte, 4)
+		binary.BigEndian.PutUint16(fixed[0:2], qst.QTYPE)
+		binary.BigEndian.PutUint16(fixed[2:4], qst.QCLASS)
+		msg = append(msg, fixed...)
+	}
+	for _, section := range [][]DNSMsgRR{m.Asr, m.Ns, m.Add} {
+		for _, rr := range section {
+			msg = packRR(msg, rr, c)
+		}
+	}
+	return
+}
+
+// allRRs is a function to list RRs of answer, authority and additional sections in order
+func (m DNSMsg) allRRs() (rrs []DNSMsgRR) {
+	rrs = append(rrs, m.Asr...)
+	rrs = append(rrs, m.Ns...)
+	return append(rrs, m.Add...)
+}
+
+// truncateMsg is a function to fit msg into limit octets for a client over UDP
+// RRs are dropped from the end (additional, then authority, then answer) so msg ends at a RR boundary,
+// TC is set if any answer or authority RR is dropped, so the client knows to retry over TCP
+func truncateMsg(msg []byte, limit int) []byte {
+	if len(msg) <= limit {
+		return msg
+	}
+	m, err := unpackDNSMsg(msg)
+	if err != nil {
+		// not expected for a message composed or checked by DNS Relay, keep header and set TC
+		hdr, hdrErr := parseDNSHdr(msg)
+		if hdrErr != nil {
+			return nil
+		}
+		m = DNSMsg{Hdr: hdr}
+		m.Hdr.FLAGS |= 0x0200
+		return packDNSMsg(m)
+	}
+
+	// OPT is never dropped, so the client still learns the negotiated payload size, RFC-6891 7
+	var opts []DNSMsgRR
+	for _, rr := range m.Add {
+		if rr.TYPE == typeOPT {
+			opts = append(opts, rr)
+		}
+	}
+	m.Add = withoutOPT(m.Add)
+	for _, section := range []*[]DNSMsgRR{&m.Add, &m.Ns, &m.Asr} {
+		for len(*section) > 0 {
+			*section = (*section)[:len(*section)-1]
+			if section != &m.Add {
+				m.Hdr.FLAGS |= 0x0200
+			}
+			truncated := m
+			truncated.Add = append(append([]DNSMsgRR(nil), m.Add...), opts...)
+			if msg = packDNSMsg(truncated); len(msg) <= limit {
+				return msg
+			}
+		}
+	}
+	return msg
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// testUnpack unpack msg, returning its header and RRs of all sections
+func testUnpack(t *testing.T, msg []byte) (hdr DNSMsgHdr, rrs []DNSMsgRR) {
+	t.Helper()
+	m, err := unpackDNSMsg(msg)
+	if err != nil {
+		t.Fatalf("unpack %v: %v", msg, err)
+	}
+	return m.Hdr, m.allRRs()
+}
+
+// testCompressedResponse is a reply of "www.baidu.com A" captured from a remote DNS:
+// a CNAME answer pointing into the question, and two A answers pointing into the CNAME
+var testCompressedResponse = []byte{
+	0x6a, 0xec, 0x81, 0x80, 0x00, 0x01, 0x00, 0x03, 0x00, 0x00, 0x00, 0x00,
+	// question: www.baidu.com A IN
+	0x03, 'w', 'w', 'w', 0x05, 'b', 'a', 'i', 'd', 'u', 0x03, 'c', 'o', 'm', 0x00,
+	0x00, 0x01, 0x00, 0x01,
+	// answer 1: C0 0C CNAME IN 600, www.a.shifen.com => 03 www 01 a 06 shifen C0 16
+	0xc0, 0x0c, 0x00, 0x05, 0x00, 0x01, 0x00, 0x00, 0x02, 0x58, 0x00, 0x0f,
+	0x03, 'w', 'w', 'w', 0x01, 'a', 0x06, 's', 'h', 'i', 'f', 'e', 'n', 0xc0, 0x16,
+	// answer 2: C0 2B(www.a.shifen.com) A IN 300 14.215.177.38
+	0xc0, 0x2b, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x01, 0x2c, 0x00, 0x04,
+	0x0e, 0xd7, 0xb1, 0x26,
+	// answer 3: C0 2B A IN 300 14.215.177.39
+	0xc0, 0x2b, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x01, 0x2c, 0x00, 0x04,
+	0x0e, 0xd7, 0xb1, 0x27,
+}
+
+func TestUnpackDNSMsg(t *testing.T) {
+	m, err := unpackDNSMsg(testCompressedResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Qst) != 1 || len(m.Asr) != 3 || len(m.Ns) != 0 || len(m.Add) != 0 {
+		t.Fatalf("unexpected sections: %+v", m)
+	}
+	if got := m.Qst[0].parseDomainName(); got != "www.baidu.com" {
+		t.Errorf("question is %s", got)
+	}
+	cname := m.Asr[0]
+	if !bytes.Equal(cname.NAME, testQNAME("www.baidu.com")) {
+		t.Errorf("CNAME owner is %v", cname.NAME)
+	}
+	if !bytes.Equal(cname.RDATA, testQNAME("www.a.shifen.com")) || int(cname.RDLENGTH) != len(cname.RDATA) {
+		t.Errorf("CNAME RDATA is %v, RDLENGTH %d", cname.RDATA, cname.RDLENGTH)
+	}
+	for _, a := range m.Asr[1:] {
+		if !bytes.Equal(a.NAME, testQNAME("www.a.shifen.com")) || a.TTL != 300 || len(a.RDATA) != 4 {
+			t.Errorf("unexpected A answer: %+v", a)
+		}
+	}
+}
+
+func TestPackDNSMsgRoundTrip(t *testing.T) {
+	m, err := unpackDNSMsg(testCompressedResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packed := packDNSMsg(m)
+	// the captured reply is compressed the same way packDNSMsg does
+	if !bytes.Equal(packed, testCompressedResponse) {
+		t.Errorf("packed message differs:\n got %v\nwant %v", packed, testCompressedResponse)
+	}
+	again, err := unpackDNSMsg(packed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(again, m) {
+		t.Errorf("round trip changes message:\n got %+v\nwant %+v", again, m)
+	}
+}
+
+func TestPackDNSMsgRDATANames(t *testing.T) {
+	soa := append(testQNAME("ns1.example.com"), testQNAME("admin.example.com")...)
+	soa = append(soa, make([]byte, 20)...)
+	binary.BigEndian.PutUint32(soa[len(soa)-4:], 300)
+	mx := append([]byte{0x00, 0x0a}, testQNAME("mail.example.com")...)
+	srv := append([]byte{0x00, 0x01, 0x00, 0x02, 0x00, 0x35}, testQNAME("ns1.example.com")...)
+	m := DNSMsg{
+		Hdr: DNSMsgHdr{ID: 1, FLAGS: 0x8180},
+		Qst: []DNSMsgQst{{QNAME: testQNAME("example.com"), QTYPE: 255, QCLASS: 1}},
+		Asr: []DNSMsgRR{
+			{NAME: testQNAME("example.com"), TYPE: 15, CLASS: 1, TTL: 60, RDATA: mx},
+			{NAME: testQNAME("_dns._udp.example.com"), TYPE: 33, CLASS: 1, TTL: 60, RDATA: srv},
+		},
+		Ns: []DNSMsgRR{
+			{NAME: testQNAME("EXAMPLE.com"), TYPE: 6, CLASS: 1, TTL: 60, RDATA: soa},
+		},
+	}
+	packed := packDNSMsg(m)
+	got, err := unpackDNSMsg(packed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, rr := range got.allRRs() {
+		want := m.allRRs()[i]
+		if !bytes.Equal(rr.RDATA, want.RDATA) || int(rr.RDLENGTH) != len(want.RDATA) {
+			t.Errorf("RR %d RDATA is %v, want %v", i, rr.RDATA, want.RDATA)
+		}
+	}
+	// example.com is packed once in question, and once more in SRV target which is never compressed,
+	// the other names are pointers or labels followed by pointers
+	if n := bytes.Count(packed, []byte("example")); n != 2 {
+		t.Errorf("\"example\" appears %d times in packed message, want 2", n)
+	}
+}
+
+func TestUnpackDNSMsgMalformed(t *testing.T) {
+	hdr := []byte{0x6a, 0xec, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	label64 := append([]byte{64}, bytes.Repeat([]byte{'a'}, 64)...)
+	var longName []byte
+	for i := 0; i < 5; i++ {
+		longName = append(longName, 63)
+		longName = append(longName, bytes.Repeat([]byte{'a'}, 63)...)
+	}
+	join := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+
+	testData := []struct {
+		name string
+		msg  []byte
+		err  error
+	}{
+		{"empty", nil, errShortMsg},
+		{"short header", hdr[:11], errShortMsg},
+		{"missing question", hdr, errShortMsg},
+		{"unterminated name", join(hdr, []byte{0x03, 'w', 'w', 'w'}), errShortMsg},
+		{"label overruns message", join(hdr, []byte{0x3f, 'w', 'w', 'w'}), errShortMsg},
+		{"missing QCLASS", join(hdr, testQNAME("google.com"), []byte{0x00, 0x01}), errShortMsg},
+		{"label over 63 octets", join(hdr, label64, []byte{0x00, 0x00, 0x01, 0x00, 0x01}), errBadLabel},
+		{"name over 255 octets", join(hdr, longName, []byte{0x00, 0x00, 0x01, 0x00, 0x01}), errLongName},
+		{"pointer to itself", join(hdr, []byte{0xc0, 0x0c, 0x00, 0x01, 0x00, 0x01}), errBadPointer},
+		{"forward pointer", join(hdr, []byte{0xc0, 0x12, 0x00, 0x01, 0x00, 0x01, 0x00}), errBadPointer},
+		{"trailing garbage", join(hdr, testQNAME("google.com"), []byte{0x00, 0x01, 0x00, 0x01, 0xde, 0xad}), errTrailingMsg},
+	}
+	for _, data := range testData {
+		if _, err := unpackDNSMsg(data.msg); err != data.err {
+			t.Errorf("%s: got error %v, want %v", data.name, err, data.err)
+		}
+	}
+
+	// pointer loop: QNAME "a" continues at answer NAME (offset 20), which points back to QNAME
+	loop := join([]byte{0x6a, 0xec, 0x81, 0x80, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00},
+		[]byte{0x01, 'a', 0xc0, 0x14, 0x00, 0x01, 0x00, 0x01},
+		[]byte{0xc0, 0x0c, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x3c, 0x00, 0x00})
+	if _, err := unpackDNSMsg(loop); err != errBadPointer {
+		t.Errorf("pointer loop: got error %v, want %v", err, errBadPointer)
+	}
+}
+
+func TestParseDNSRequestMalformed(t *testing.T) {
+	testData := [][]byte{
+		nil,
+		{0x6a, 0xec, 0x01, 0x00},
+		// QDCOUNT 0
+		{0x6a, 0xec, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+		// QNAME never ends
+		{0x6a, 0xec, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x05, 'g', 'o'},
+		// QNAME is a pointer
+		{0x6a, 0xec, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xc0, 0x0c, 0x00, 0x01, 0x00, 0x01},
+	}
+	for _, msg := range testData {
+		if _, _, _, err := parseDNSRequest(msg); err == nil {
+			t.Errorf("request %v should be an error", msg)
+		}
+	}
+	truncated := DNSMsgQst{QNAME: []byte{0x06, 'g', 'o', 'o'}}
+	if got := truncated.parseDomainName(); got != "" {
+		t.Errorf("truncated QNAME is translated into %q", got)
+	}
+}
+
+// TestUnpackDNSMsgNoPanic feeds parsers with random mutations of a valid reply
+func TestUnpackDNSMsgNoPanic(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1035))
+	for i := 0; i < 20000; i++ {
+		msg := append([]byte(nil), testCompressedResponse...)
+		for n := rnd.Intn(4) + 1; n > 0; n-- {
+			msg[rnd.Intn(len(msg))] = byte(rnd.Intn(256))
+		}
+		msg = msg[:rnd.Intn(len(msg)+1)]
+		if m, err := unpackDNSMsg(msg); err == nil {
+			packDNSMsg(m)
+		}
+		parseDNSRequest(msg)
+	}
+}
+
+func TestComposeFormErr(t *testing.T) {
+	query := DNSMsgHdr{ID: 0x6aec, FLAGS: 0x0100, QDCOUNT: 1, ARCOUNT: 1}
+	resp := composeFormErr(query)
+	hdr, err := parseDNSHdr(resp)
+	if err != nil || len(resp) != 12 {
+		t.Fatalf("FORMERR should carry the header only: %v", resp)
+	}
+	flags := hdr.parseFlags()
+	if hdr.ID != 0x6aec || flags.QR != 1 || flags.RD != 1 || flags.RCODE != 1 || hdr.QDCOUNT != 0 {
+		t.Errorf("unexpected FORMERR header: %+v, flags: %+v", hdr, flags)
+	}
+}
+
+func TestComposeNotImp(t *testing.T) {
+	// UPDATE(5) with RD
+	query := DNSMsgHdr{ID: 0x6aec, FLAGS: 0x2900, QDCOUNT: 1, NSCOUNT: 1}
+	resp := composeNotImp(query)
+	hdr, err := parseDNSHdr(resp)
+	if err != nil || len(resp) != 12 {
+		t.Fatalf("NOTIMP should carry the header only: %v", resp)
+	}
+	flags := hdr.parseFlags()
+	if hdr.ID != 0x6aec || flags.QR != 1 || flags.Opcode != 5 || flags.RCODE != 4 || hdr.QDCOUNT != 0 {
+		t.Errorf("unexpected NOTIMP header: %+v, flags: %+v", hdr, flags)
+	}
+}
+
+// testLargeMsg compose a reply of domainName with n A answers, n NS authorities and n A additionals
+func testLargeMsg(domainName string, n int) DNSMsg {
+	m := DNSMsg{
+		Hdr: DNSMsgHdr{ID: 0x6aec, FLAGS: 0x8180},
+		Qst: []DNSMsgQst{{QNAME: testQNAME(domainName), QTYPE: 1, QCLASS: 1}},
+	}
+	for i := 0; i < n; i++ {
+		ns := testQNAME("ns" + strconv.Itoa(i) + "." + domainName)
+		m.Asr = append(m.Asr, DNSMsgRR{NAME: testQNAME(domainName), TYPE: 1, CLASS: 1, TTL: 60, RDATA: []byte{10, 0, 0, byte(i)}})
+		m.Ns = append(m.Ns, DNSMsgRR{NAME: testQNAME(domainName), TYPE: 2, CLASS: 1, TTL: 60, RDATA: ns})
+		m.Add = append(m.Add, DNSMsgRR{NAME: ns, TYPE: 1, CLASS: 1, TTL: 60, RDATA: []byte{10, 1, 0, byte(i)}})
+	}
+	return m
+}
+
+func TestTruncateMsg(t *testing.T) {
+	small := packDNSMsg(testLargeMsg("www.ljg.top", 2))
+	if got := truncateMsg(small, minUDPSize); !bytes.Equal(got, small) {
+		t.Error("message within limit should not be changed")
+	}
+
+	large := packDNSMsg(testLargeMsg("www.ljg.top", 40))
+	if len(large) <= minUDPSize {
+		t.Fatalf("test message is only %d octets", len(large))
+	}
+	truncated := truncateMsg(large, minUDPSize)
+	if len(truncated) > minUDPSize {
+		t.Fatalf("truncated message is %d octets", len(truncated))
+	}
+	m, err := unpackDNSMsg(truncated)
+	if err != nil {
+		t.Fatalf("truncated message should end at a RR boundary: %v", err)
+	}
+	if m.Hdr.parseFlags().TC != 1 {
+		t.Error("TC should be set once answers are dropped")
+	}
+	if len(m.Add) != 0 || len(m.Ns) != 0 || len(m.Asr) == 0 || len(m.Asr) == 40 {
+		t.Errorf("additional and authority should be dropped before answers, got %d/%d/%d",
+			len(m.Asr), len(m.Ns), len(m.Add))
+	}
+
+	// only additional RRs are dropped, TC is not needed
+	m = testLargeMsg("www.ljg.top", 12)
+	m.Add = append(m.Add, m.Add...)
+	extra := packDNSMsg(m)
+	limit := len(packDNSMsg(DNSMsg{Hdr: m.Hdr, Qst: m.Qst, Asr: m.Asr, Ns: m.Ns}))
+	got, err := unpackDNSMsg(truncateMsg(extra, limit))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Hdr.parseFlags().TC != 0 || len(got.Asr) != 12 || len(got.Ns) != 12 {
+		t.Errorf("dropping additional RRs only should keep TC cleared, got %+v", got.Hdr)
+	}
+}
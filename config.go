@@ -0,0 +1,440 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Duration is a time.Duration read from config file as "2s", "500ms" and so on
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalJSON is a function to read Duration from a string such as "2s"
+func (d *Duration) UnmarshalJSON(b []byte) (err error) {
+	var s string
+	if err = json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration should be a string like \"2s\": %s", string(b))
+	}
+	d.Duration, err = time.ParseDuration(s)
+	return
+}
+
+// MarshalJSON is a function to write Duration as a string such as "2s"
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// Config is the configuration of DNS Relay
+// Listen: addresses DNS Relay serves clients on, such as ":53"
+// Upstreams: addresses of remote DNS (port 53 if omitted)
+// UpstreamProtocol: "udp" (retried over TCP once truncated) or "tcp" for queries towards upstreams
+// UpstreamStrategy: how to pick an upstream, "failover", "round-robin", "random" or "fastest"
+// MaxFails: consecutive failures before an upstream is ejected
+// HealthCheckInterval: how often every upstream is probed, ejected ones are admitted again once they answer
+// TCPIdleTimeout: how long a TCP connection from a client may stay idle before it's closed
+// Hosts: paths of hosts files, names found in them are answered locally
+// WatchHosts: reload hosts files once they change, they are reloaded on SIGHUP anyway
+// HostsPollInterval: how often hosts files are checked for changes where inotify is not available
+// UpstreamTimeout: how long to wait for an answer from remote DNS, for each attempt
+// Retries: attempts after the first one, clients get SERVFAIL once all of them fail
+// RetryBackoff: pause before the first retry, doubled before each following retry
+// RetryOtherUpstream: whether a retry prefers an upstream not tried yet for the query
+// EDNSUDPSize: largest UDP payload (octets) advertised in EDNS(0) OPT, to clients and to upstreams
+// CacheSize: number of answers from remote DNS kept in cache, 0 disables cache
+// LocalTTL: TTL of answers found in hosts files
+// BlockMode: how names mapped to 0.0.0.0 or :: in hosts files are answered: "nxdomain", "nodata",
+// "refused", "null" (0.0.0.0 and ::) or "sinkhole" (addresses of Sinkhole), see composeBlock
+// Sinkhole: addresses answered for blocked names in sinkhole mode, IPv4 and/or IPv6
+// Blocklists: lists of names to block by BlockMode besides hosts files, see Blocklist
+// Allowlist: names never blocked, by hosts files or blocklists, exact, "*.suffix" or ".suffix"
+// MaxNegativeTTL: upper bound of TTL (second) for cached NXDOMAIN/NODATA
+// QueryLog: path of query log, a JSON object per query, "" disables it
+// QueryLogMaxSize: megabytes query log grows to before it's rotated, 0 disables rotation by size
+// QueryLogRotateInterval: how often query log is rotated, 0 disables rotation by time
+// QueryLogCompress: gzip rotated query logs
+// QueryLogMaxBackups: number of rotated query logs kept, 0 keeps all of them
+// QueryLogMaxAge: how long rotated query logs are kept, 0 keeps them however old
+// ShutdownTimeout: how long queries in flight are waited for once SIGINT or SIGTERM is received
+// MetricsListen: address of HTTP server of Prometheus metrics at /metrics, such as "127.0.0.1:9153", "" disables it
+// LogLevel: least level of logs, "debug" (every query), "info", "warn" or "error"
+// LogFormat: "text" (key=value pairs) or "json" (an object per line), logs go to stderr
+// Verbose: log every query, the same as LogLevel "debug"
+type Config struct {
+	Listen                 []string    `json:"listen"`
+	Upstreams              []string    `json:"upstreams"`
+	UpstreamProtocol       string      `json:"upstream_protocol"`
+	UpstreamStrategy       string      `json:"upstream_strategy"`
+	MaxFails               int         `json:"max_fails"`
+	HealthCheckInterval    Duration    `json:"health_check_interval"`
+	TCPIdleTimeout         Duration    `json:"tcp_idle_timeout"`
+	Hosts                  []string    `json:"hosts"`
+	WatchHosts             bool        `json:"watch_hosts"`
+	HostsPollInterval      Duration    `json:"hosts_poll_interval"`
+	UpstreamTimeout        Duration    `json:"upstream_timeout"`
+	Retries                int         `json:"retries"`
+	RetryBackoff           Duration    `json:"retry_backoff"`
+	RetryOtherUpstream     bool        `json:"retry_other_upstream"`
+	EDNSUDPSize            uint16      `json:"edns_udp_size"`
+	CacheSize              int         `json:"cache_size"`
+	LocalTTL               uint32      `json:"local_ttl"`
+	BlockMode              string      `json:"block_mode"`
+	Sinkhole               []string    `json:"sinkhole"`
+	Blocklists             []Blocklist `json:"blocklists"`
+	Allowlist              []string    `json:"allowlist"`
+	MaxNegativeTTL         uint32      `json:"max_negative_ttl"`
+	QueryLog               string      `json:"query_log"`
+	QueryLogMaxSize        int         `json:"query_log_max_size"`
+	QueryLogRotateInterval Duration    `json:"query_log_rotate_interval"`
+	QueryLogCompress       bool        `json:"query_log_compress"`
+	QueryLogMaxBackups     int         `json:"query_log_max_backups"`
+	QueryLogMaxAge         Duration    `json:"query_log_max_age"`
+	ShutdownTimeout        Duration    `json:"shutdown_timeout"`
+	MetricsListen          string      `json:"metrics_listen"`
+	LogLevel               string      `json:"log_level"`
+	LogFormat              string      `json:"log_format"`
+	Verbose                bool        `json:"verbose"`
+}
+
+// defaultEDNSUDPSize avoids IP fragmentation on common paths, as DNS Flag Day 2020 suggests
+const defaultEDNSUDPSize = 1232
+
+// defaultConfig is a function to generate Config used when nothing is specified
+func defaultConfig() *Config {
+	return &Config{
+		Listen:                 []string{":53"},
+		Upstreams:              []string{"192.168.10.1:53"},
+		UpstreamProtocol:       "udp",
+		UpstreamStrategy:       strategyFailover,
+		MaxFails:               3,
+		HealthCheckInterval:    Duration{10 * time.Second},
+		TCPIdleTimeout:         Duration{10 * time.Second},
+		Hosts:                  []string{"hosts"},
+		WatchHosts:             true,
+		HostsPollInterval:      Duration{5 * time.Second},
+		UpstreamTimeout:        Duration{2 * time.Second},
+		Retries:                2,
+		RetryBackoff:           Duration{100 * time.Millisecond},
+		RetryOtherUpstream:     true,
+		EDNSUDPSize:            defaultEDNSUDPSize,
+		CacheSize:              defaultCacheSize,
+		LocalTTL:               31,
+		BlockMode:              blockNXDomain,
+		MaxNegativeTTL:         defaultMaxNegativeTTL,
+		QueryLogMaxSize:        100,
+		QueryLogRotateInterval: Duration{24 * time.Hour},
+		QueryLogMaxBackups:     7,
+		ShutdownTimeout:        Duration{5 * time.Second},
+		LogLevel:               "info",
+		LogFormat:              logText,
+		Verbose:                false,
+	}
+}
+
+// stringList is a flag.Value of comma separated strings
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = nil
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+// loadConfig is a function to build Config from command-line arguments
+// the precedence is: flags set explicitly > config file (-config) > defaultConfig
+func loadConfig(args []string) (cfg *Config, err error) {
+	fs := flag.NewFlagSet("DNS-Relay", flag.ContinueOnError)
+	configPath := fs.String("config", "", "path of JSON config file")
+	listen := stringList{}
+	upstreams := stringList{}
+	hosts := stringList{}
+	sinkhole := stringList{}
+	allowlist := stringList{}
+	fs.Var(&listen, "listen", "comma separated addresses to serve clients on (default \":53\")")
+	fs.Var(&upstreams, "upstream", "comma separated addresses of remote DNS (default \"192.168.10.1:53\")")
+	fs.Var(&hosts, "hosts", "comma separated paths of hosts files (default \"hosts\")")
+	watchHosts := fs.Bool("watch-hosts", true, "reload hosts files once they change")
+	hostsPoll := fs.Duration("hosts-poll-interval", 0, "how often hosts files are checked without inotify (default 5s)")
+	protocol := fs.String("upstream-protocol", "", "protocol towards remote DNS: udp (TCP once truncated) or tcp (default \"udp\")")
+	tcpIdle := fs.Duration("tcp-idle-timeout", 0, "how long a TCP connection from clients may stay idle (default 10s)")
+	strategy := fs.String("strategy", "", "how to pick remote DNS: failover, round-robin, random or fastest (default \"failover\")")
+	maxFails := fs.Int("max-fails", 0, "consecutive failures before remote DNS is ejected (default 3)")
+	healthInterval := fs.Duration("health-interval", 0, "how often remote DNS is probed (default 10s)")
+	timeout := fs.Duration("timeout", 0, "how long to wait for remote DNS, for each attempt (default 2s)")
+	retries := fs.Int("retries", 0, "attempts after the first one (default 2)")
+	retryBackoff := fs.Duration("retry-backoff", 0, "pause before the first retry, doubled each retry (default 100ms)")
+	retryOther := fs.Bool("retry-other-upstream", true, "retry with another remote DNS if possible")
+	ednsUDPSize := fs.Uint("edns-udp-size", 0, "largest UDP payload advertised with EDNS(0) (default 1232)")
+	cacheSize := fs.Int("cache-size", 0, "number of answers kept in cache, 0 disables cache (default 4096)")
+	blockMode := fs.String("block-mode", "", "how blocked names are answered: nxdomain, nodata, refused, null or sinkhole (default \"nxdomain\")")
+	fs.Var(&sinkhole, "sinkhole", "comma separated addresses answered for blocked names in sinkhole mode")
+	fs.Var(&allowlist, "allowlist", "comma separated names never blocked, such as www.example.com or *.example.com")
+	localTTL := fs.Uint("ttl", 0, "TTL of answers found in hosts files (default 31)")
+	maxNegativeTTL := fs.Uint("max-negative-ttl", 0, "upper bound of TTL for cached NXDOMAIN/NODATA (default 10800)")
+	queryLog := fs.String("query-log", "", "path of query log, disabled if not set")
+	queryLogMaxSize := fs.Int("query-log-max-size", 0, "megabytes query log grows to before it's rotated (default 100)")
+	queryLogRotate := fs.Duration("query-log-rotate-interval", 0, "how often query log is rotated (default 24h)")
+	queryLogCompress := fs.Bool("query-log-compress", false, "gzip rotated query logs")
+	queryLogMaxBackups := fs.Int("query-log-max-backups", 0, "number of rotated query logs kept (default 7)")
+	queryLogMaxAge := fs.Duration("query-log-max-age", 0, "how long rotated query logs are kept, 0 keeps them however old")
+	shutdownTimeout := fs.Duration("shutdown-timeout", 0, "how long queries in flight are waited for on SIGINT or SIGTERM (default 5s)")
+	metricsListen := fs.String("metrics-listen", "", "address to serve Prometheus metrics on at /metrics, disabled if not set")
+	logLevel := fs.String("log-level", "", "least level of logs: debug, info, warn or error (default \"info\")")
+	logFormat := fs.String("log-format", "", "format of logs: text or json (default \"text\")")
+	verbose := fs.Bool("verbose", false, "log every query, the same as -log-level debug")
+	if err = fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+
+	cfg = defaultConfig()
+	if *configPath != "" {
+		if err = cfg.loadFile(*configPath); err != nil {
+			return nil, err
+		}
+	}
+
+	// only flags set explicitly override config file
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			cfg.Listen = listen
+		case "upstream":
+			cfg.Upstreams = upstreams
+		case "upstream-protocol":
+			cfg.UpstreamProtocol = *protocol
+		case "tcp-idle-timeout":
+			cfg.TCPIdleTimeout.Duration = *tcpIdle
+		case "strategy":
+			cfg.UpstreamStrategy = *strategy
+		case "max-fails":
+			cfg.MaxFails = *maxFails
+		case "health-interval":
+			cfg.HealthCheckInterval.Duration = *healthInterval
+		case "hosts":
+			cfg.Hosts = hosts
+		case "watch-hosts":
+			cfg.WatchHosts = *watchHosts
+		case "hosts-poll-interval":
+			cfg.HostsPollInterval.Duration = *hostsPoll
+		case "timeout":
+			cfg.UpstreamTimeout.Duration = *timeout
+		case "retries":
+			cfg.Retries = *retries
+		case "retry-backoff":
+			cfg.RetryBackoff.Duration = *retryBackoff
+		case "retry-other-upstream":
+			cfg.RetryOtherUpstream = *retryOther
+		case "edns-udp-size":
+			if *ednsUDPSize > maxUDPSize {
+				*ednsUDPSize = maxUDPSize
+			}
+			cfg.EDNSUDPSize = uint16(*ednsUDPSize)
+		case "cache-size":
+			cfg.CacheSize = *cacheSize
+		case "block-mode":
+			cfg.BlockMode = *blockMode
+		case "sinkhole":
+			cfg.Sinkhole = sinkhole
+		case "allowlist":
+			cfg.Allowlist = allowlist
+		case "ttl":
+			cfg.LocalTTL = uint32(*localTTL)
+		case "max-negative-ttl":
+			cfg.MaxNegativeTTL = uint32(*maxNegativeTTL)
+		case "query-log":
+			cfg.QueryLog = *queryLog
+		case "query-log-max-size":
+			cfg.QueryLogMaxSize = *queryLogMaxSize
+		case "query-log-rotate-interval":
+			cfg.QueryLogRotateInterval.Duration = *queryLogRotate
+		case "query-log-compress":
+			cfg.QueryLogCompress = *queryLogCompress
+		case "query-log-max-backups":
+			cfg.QueryLogMaxBackups = *queryLogMaxBackups
+		case "query-log-max-age":
+			cfg.QueryLogMaxAge.Duration = *queryLogMaxAge
+		case "shutdown-timeout":
+			cfg.ShutdownTimeout.Duration = *shutdownTimeout
+		case "metrics-listen":
+			cfg.MetricsListen = *metricsListen
+		case "log-level":
+			cfg.LogLevel = *logLevel
+		case "log-format":
+			cfg.LogFormat = *logFormat
+		case "verbose":
+			cfg.Verbose = *verbose
+		}
+	})
+
+	if err = cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// loadFile is a function to override cfg with fields present in a JSON config file
+func (cfg *Config) loadFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("open config file: %w", err)
+	}
+	defer file.Close()
+
+	dec := json.NewDecoder(file)
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(cfg); err != nil {
+		return fmt.Errorf("parse config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// validate is a function to check Config and complete upstream addresses with port 53
+func (cfg *Config) validate() error {
+	if len(cfg.Listen) == 0 {
+		return errors.New("config: at least one listen address is required")
+	}
+	for _, addr := range cfg.Listen {
+		if _, err := net.ResolveUDPAddr("udp", addr); err != nil {
+			return fmt.Errorf("config: invalid listen address %q: %w", addr, err)
+		}
+	}
+
+	if len(cfg.Upstreams) == 0 {
+		return errors.New("config: at least one upstream is required")
+	}
+	for i, addr := range cfg.Upstreams {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(strings.Trim(addr, "[]"), "53")
+		}
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil || net.ParseIP(host) == nil {
+			return fmt.Errorf("config: upstream %q should be an IP address with optional port", cfg.Upstreams[i])
+		}
+		if _, err = net.ResolveUDPAddr("udp", addr); err != nil {
+			return fmt.Errorf("config: invalid upstream %q: %w", cfg.Upstreams[i], err)
+		}
+		cfg.Upstreams[i] = addr
+	}
+
+	if cfg.UpstreamProtocol != "udp" && cfg.UpstreamProtocol != "tcp" {
+		return fmt.Errorf("config: upstream_protocol should be \"udp\" or \"tcp\", not %q", cfg.UpstreamProtocol)
+	}
+	if cfg.TCPIdleTimeout.Duration <= 0 {
+		return errors.New("config: tcp_idle_timeout should be positive")
+	}
+	switch cfg.UpstreamStrategy {
+	case strategyFailover, strategyRoundRobin, strategyRandom, strategyFastest:
+	default:
+		return fmt.Errorf("config: unknown upstream_strategy %q", cfg.UpstreamStrategy)
+	}
+	if cfg.MaxFails <= 0 {
+		return errors.New("config: max_fails should be positive")
+	}
+	if cfg.HealthCheckInterval.Duration <= 0 {
+		return errors.New("config: health_check_interval should be positive")
+	}
+
+	if cfg.HostsPollInterval.Duration <= 0 {
+		return errors.New("config: hosts_poll_interval should be positive")
+	}
+	if cfg.UpstreamTimeout.Duration <= 0 {
+		return errors.New("config: upstream_timeout should be positive")
+	}
+	if cfg.Retries < 0 {
+		return errors.New("config: retries should not be negative")
+	}
+	if cfg.RetryBackoff.Duration < 0 {
+		return errors.New("config: retry_backoff should not be negative")
+	}
+	if cfg.EDNSUDPSize < minUDPSize {
+		return fmt.Errorf("config: edns_udp_size should be at least %d", minUDPSize)
+	}
+	if cfg.CacheSize < 0 {
+		return errors.New("config: cache_size should not be negative")
+	}
+	cfg.BlockMode = strings.ToLower(cfg.BlockMode)
+	if !isBlockMode(cfg.BlockMode) {
+		return fmt.Errorf("config: unknown block_mode %q", cfg.BlockMode)
+	}
+	for _, addr := range cfg.Sinkhole {
+		if net.ParseIP(addr) == nil {
+			return fmt.Errorf("config: sinkhole %q should be an IP address", addr)
+		}
+	}
+	if cfg.BlockMode == blockSinkhole && len(cfg.Sinkhole) == 0 {
+		return errors.New("config: block_mode \"sinkhole\" requires sinkhole addresses")
+	}
+	for i, list := range cfg.Blocklists {
+		if list.Path == "" {
+			return errors.New("config: path of blocklist is required")
+		}
+		cfg.Blocklists[i].Format = strings.ToLower(list.Format)
+		switch cfg.Blocklists[i].Format {
+		case formatHosts, formatDomains, formatAdblock:
+		default:
+			return fmt.Errorf("config: format of blocklist %s should be \"hosts\", \"domains\" or \"adblock\", not %q", list.Path, list.Format)
+		}
+	}
+	if err := checkAllowlist(cfg.Allowlist); err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	if cfg.LocalTTL > 0x7fffffff || cfg.MaxNegativeTTL > 0x7fffffff {
+		return errors.New("config: TTL should not exceed 2147483647 (RFC-2181)")
+	}
+	if cfg.QueryLogMaxSize < 0 || cfg.QueryLogRotateInterval.Duration < 0 || cfg.QueryLogMaxBackups < 0 || cfg.QueryLogMaxAge.Duration < 0 {
+		return errors.New("config: query_log_max_size, query_log_rotate_interval, query_log_max_backups and query_log_max_age should not be negative")
+	}
+	if cfg.ShutdownTimeout.Duration <= 0 {
+		return errors.New("config: shutdown_timeout should be positive")
+	}
+	if cfg.MetricsListen != "" {
+		if _, err := net.ResolveTCPAddr("tcp", cfg.MetricsListen); err != nil {
+			return fmt.Errorf("config: invalid metrics_listen %q: %w", cfg.MetricsListen, err)
+		}
+	}
+	if _, err := parseLogLevel(cfg.LogLevel); err != nil {
+		return fmt.Errorf("config: log_level should be \"debug\", \"info\", \"warn\" or \"error\", not %q", cfg.LogLevel)
+	}
+	cfg.LogFormat = strings.ToLower(cfg.LogFormat)
+	if cfg.LogFormat != logText && cfg.LogFormat != logJSON {
+		return fmt.Errorf("config: log_format should be \"text\" or \"json\", not %q", cfg.LogFormat)
+	}
+	return nil
+}
+
+// logLevel is a function to get the least level of logs, debug if cfg.Verbose is set
+func (cfg *Config) logLevel() slog.Level {
+	if cfg.Verbose {
+		return slog.LevelDebug
+	}
+	level, _ := parseLogLevel(cfg.LogLevel)
+	return level
+}
+
+// retryPolicy is a function to draw retryPolicy of queries towards remote DNS from cfg
+func (cfg *Config) retryPolicy() retryPolicy {
+	return retryPolicy{
+		timeout:       cfg.UpstreamTimeout.Duration,
+		retries:       cfg.Retries,
+		backoff:       cfg.RetryBackoff.Duration,
+		otherUpstream: cfg.RetryOtherUpstream,
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testConfigFile write content into a config file in a temporary directory
+func testConfigFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "relay.json")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigDefault(t *testing.T) {
+	cfg, err := loadConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Listen[0] != ":53" || cfg.Upstreams[0] != "192.168.10.1:53" || cfg.Hosts[0] != "hosts" {
+		t.Errorf("unexpected default config: %+v", cfg)
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := testConfigFile(t, `{
+		"listen": ["127.0.0.1:5353"],
+		"upstreams": ["8.8.8.8", "[2001:4860:4860::8888]"],
+		"upstream_timeout": "500ms",
+		"cache_size": 100
+	}`)
+	cfg, err := loadConfig([]string{"-config", path, "-cache-size", "10", "-hosts", "a.hosts, b.hosts"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// from config file, upstreams completed with port 53
+	if cfg.Listen[0] != "127.0.0.1:5353" {
+		t.Errorf("listen is %v", cfg.Listen)
+	}
+	if cfg.Upstreams[0] != "8.8.8.8:53" || cfg.Upstreams[1] != "[2001:4860:4860::8888]:53" {
+		t.Errorf("upstreams are %v", cfg.Upstreams)
+	}
+	if cfg.UpstreamTimeout.Duration != 500*time.Millisecond {
+		t.Errorf("upstream timeout is %s", cfg.UpstreamTimeout)
+	}
+	// flags override config file
+	if cfg.CacheSize != 10 {
+		t.Errorf("cache size is %d, want 10", cfg.CacheSize)
+	}
+	if len(cfg.Hosts) != 2 || cfg.Hosts[1] != "b.hosts" {
+		t.Errorf("hosts are %v", cfg.Hosts)
+	}
+	// untouched by both
+	if cfg.LocalTTL != 31 {
+		t.Errorf("local TTL is %d, want default 31", cfg.LocalTTL)
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	testData := [][]string{
+		{"-upstream", "dns.google"},
+		{"-upstream", ""},
+		{"-listen", "127.0.0.1:http-alt-x"},
+		{"-timeout", "0s"},
+		{"-cache-size", "-1"},
+		{"-config", testConfigFile(t, `{"listen": ":53"}`)},
+		{"-config", testConfigFile(t, `{"upstream_timeout": 2}`)},
+		{"-config", testConfigFile(t, `{"unknown_field": true}`)},
+		{"-config", filepath.Join(t.TempDir(), "missing.json")},
+		{"extra-argument"},
+	}
+	for _, args := range testData {
+		if _, err := loadConfig(args); err == nil {
+			t.Errorf("config %v should be rejected", args)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// DNSMsgOPT is a struct of EDNS(0) OPT pseudo-RR
+// from RFC-6891, OPT lives in additional section and reuses the fields of RR:
+// NAME: always root (00)
+// TYPE: OPT(41)
+// CLASS: UDP payload size the sender is able to receive
+// TTL: 32 bits, holding flags instead of time to live
+//
+//	                                1  1  1  1  1  1
+//	  0  1  2  3  4  5  6  7  8  9  0  1  2  3  4  5
+//	+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+//	|     EXTENDED-RCODE    |        VERSION        |
+//	+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+//	|DO|                     Z                      |
+//	+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+//
+// RDATA: options, each of them is OPTION-CODE(16), OPTION-LENGTH(16) and OPTION-DATA
+// ExtRcode: upper 8 bits of the 12-bit RCODE, lower 4 bits stay in header
+// DO: DNSSEC OK, RFC-3225
+type DNSMsgOPT struct {
+	UDPSize  uint16
+	ExtRcode uint8
+	Version  uint8
+	DO       bool
+	Options  []DNSMsgOption
+}
+
+// DNSMsgOption is a single option in RDATA of OPT, such as COOKIE(10) or ECS(8)
+type DNSMsgOption struct {
+	Code uint16
+	Data []byte
+}
+
+// typeOPT is RR TYPE of OPT, rcodeBadVers is the extended RCODE answering an unknown EDNS version
+const (
+	typeOPT      = 41
+	rcodeBadVers = 16
+)
+
+var (
+	errBadOPT   = errors.New("DNS message has malformed OPT RR")
+	errMultiOPT = errors.New("DNS message has more than one OPT RR")
+)
+
+// parseOPT is a function to draw DNSMsgOPT from a RR whose TYPE is OPT(41)
+func parseOPT(rr DNSMsgRR) (opt DNSMsgOPT, err error) {
+	if len(rr.NAME) != 1 || rr.NAME[0] != 0 {
+		return opt, errBadOPT
+	}
+	opt.UDPSize = rr.CLASS
+	opt.ExtRcode = uint8(rr.TTL >> 24)
+	opt.Version = uint8(rr.TTL >> 16)
+	opt.DO = rr.TTL&0x8000 != 0
+	for i := 0; i < len(rr.RDATA); {
+		if i+4 > len(rr.RDATA) {
+			return opt, errBadOPT
+		}
+		code := binary.BigEndian.Uint16(rr.RDATA[i : i+2])
+		length := int(binary.BigEndian.Uint16(rr.RDATA[i+2 : i+4]))
+		i += 4
+		if i+length > len(rr.RDATA) {
+			return opt, errBadOPT
+		}
+		data := append([]byte(nil), rr.RDATA[i:i+length]...)
+		opt.Options = append(opt.Options, DNSMsgOption{Code: code, Data: data})
+		i += length
+	}
+	return opt, nil
+}
+
+// toRR is a function to translate opt into a RR of additional section
+func (opt DNSMsgOPT) toRR() (rr DNSMsgRR) {
+	rr.NAME = []byte{0x00}
+	rr.TYPE = typeOPT
+	rr.CLASS = opt.UDPSize
+	rr.TTL = uint32(opt.ExtRcode)<<24 | uint32(opt.Version)<<16
+	if opt.DO {
+		rr.TTL |= 0x8000
+	}
+	for _, option := range opt.Options {
+		header := make([]byte, 4)
+		binary.BigEndian.PutUint16(header[0:2], option.Code)
+		binary.BigEndian.PutUint16(header[2:4], uint16(len(option.Data)))
+		rr.RDATA = append(rr.RDATA, header...)
+		rr.RDATA = append(rr.RDATA, option.Data...)
+	}
+	rr.RDLENGTH = uint16(len(rr.RDATA))
+	return
+}
+
+// findOPT is a function to draw OPT from additional section of m, nil if m has none
+// a message with more than one OPT, or a malformed one, is an error (FORMERR, RFC-6891 6.1.1)
+func findOPT(m DNSMsg) (opt *DNSMsgOPT, err error) {
+	for _, rr := range m.Add {
+		if rr.TYPE != typeOPT {
+			continue
+		}
+		if opt != nil {
+			return nil, errMultiOPT
+		}
+		parsed, err := parseOPT(rr)
+		if err != nil {
+			return nil, err
+		}
+		opt = &parsed
+	}
+	return opt, nil
+}
+
+// withoutOPT is a function to filter OPT out of rrs
+func withoutOPT(rrs []DNSMsgRR) (rest []DNSMsgRR) {
+	for _, rr := range rrs {
+		if rr.TYPE != typeOPT {
+			rest = append(rest, rr)
+		}
+	}
+	return
+}
+
+// udpLimit is a function to negotiate the largest UDP response to a query carrying opt
+// the client's payload size is honored up to ours, and never below 512 octets
+func udpLimit(opt *DNSMsgOPT, ours uint16) int {
+	if opt == nil {
+		return minUDPSize
+	}
+	size := int(opt.UDPSize)
+	if size > int(ours) {
+		size = int(ours)
+	}
+	if size < minUDPSize {
+		size = minUDPSize
+	}
+	return size
+}
+
+// forwardOPT is a function to build OPT of the query forwarded to remote DNS for a client's opt
+// DO and options of the client are kept, while UDP payload size is DNS Relay's own
+func forwardOPT(opt *DNSMsgOPT, udpSize uint16) *DNSMsgOPT {
+	if opt == nil {
+		return nil
+	}
+	return &DNSMsgOPT{UDPSize: udpSize, DO: opt.DO, Options: opt.Options}
+}
+
+// replyOPT is a function to attach OPT answering a query carrying opt to resp
+// OPT is hop-by-hop, so any OPT from remote DNS is replaced by one carrying DNS Relay's UDP payload size,
+// its extended RCODE and options are kept; a query without OPT gets a response without OPT
+func replyOPT(resp []byte, opt *DNSMsgOPT, udpSize uint16) []byte {
+	m, err := unpackDNSMsg(resp)
+	if err != nil {
+		return resp
+	}
+	remote, err := findOPT(m)
+	if err != nil {
+		remote = nil
+	}
+	if opt == nil && len(withoutOPT(m.Add)) == len(m.Add) {
+		return resp
+	}
+	m.Add = withoutOPT(m.Add)
+	if opt != nil {
+		reply := DNSMsgOPT{UDPSize: udpSize, DO: opt.DO}
+		if remote != nil {
+			reply.ExtRcode = remote.ExtRcode
+			reply.Options = remote.Options
+		}
+		m.Add = append(m.Add, reply.toRR())
+	}
+	return packDNSMsg(m)
+}
+
+// composeBadVers is a function to generate a BADVERS response to a query whose EDNS version is not 0
+func composeBadVers(hdr DNSMsgHdr, qst DNSMsgQst, udpSize uint16) []byte {
+	// BADVERS(16) is 1 in EXTENDED-RCODE and 0 in header
+	respHdr := DNSMsgHdr{ID: hdr.ID, FLAGS: respFlags(hdr, rcodeBadVers&0x0f)}
+	opt := DNSMsgOPT{UDPSize: udpSize, ExtRcode: rcodeBadVers >> 4}
+	return packDNSMsg(DNSMsg{Hdr: respHdr, Qst: []DNSMsgQst{qst}, Add: []DNSMsgRR{opt.toRR()}})
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// testEDNSQuery compose a query of domainName with QTYPE A and opt in additional section
+func testEDNSQuery(id uint16, domainName string, opt DNSMsgOPT) []byte {
+	hdr := DNSMsgHdr{ID: id, FLAGS: 0x0100}
+	qst := DNSMsgQst{QNAME: testQNAME(domainName), QTYPE: 1, QCLASS: 1}
+	return composeQuery(hdr, qst, &opt)
+}
+
+func TestParseOPT(t *testing.T) {
+	opt := DNSMsgOPT{
+		UDPSize: 4096, ExtRcode: 1, DO: true,
+		Options: []DNSMsgOption{{Code: 10, Data: []byte{1, 2, 3, 4, 5, 6, 7, 8}}, {Code: 12}},
+	}
+	rr := opt.toRR()
+	if rr.TYPE != 41 || rr.CLASS != 4096 || rr.TTL != 0x01008000 || rr.RDLENGTH != 16 {
+		t.Errorf("unexpected OPT RR: %+v", rr)
+	}
+	got, err := parseOPT(rr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, opt) {
+		t.Errorf("parsed %+v, want %+v", got, opt)
+	}
+
+	rr.RDATA = rr.RDATA[:len(rr.RDATA)-10]
+	if _, err = parseOPT(rr); err != errBadOPT {
+		t.Errorf("option running over RDATA should be an error, got %v", err)
+	}
+	rr = opt.toRR()
+	rr.NAME = testQNAME("www.ljg.top")
+	if _, err = parseOPT(rr); err != errBadOPT {
+		t.Errorf("OPT owned by a non-root name should be an error, got %v", err)
+	}
+
+	m := DNSMsg{Add: []DNSMsgRR{opt.toRR(), opt.toRR()}}
+	if _, err = findOPT(m); err != errMultiOPT {
+		t.Errorf("two OPT RRs should be an error, got %v", err)
+	}
+}
+
+func TestUDPLimit(t *testing.T) {
+	cases := []struct {
+		opt  *DNSMsgOPT
+		want int
+	}{
+		{nil, 512},
+		{&DNSMsgOPT{UDPSize: 0}, 512},
+		{&DNSMsgOPT{UDPSize: 1024}, 1024},
+		{&DNSMsgOPT{UDPSize: 4096}, 1232},
+	}
+	for _, c := range cases {
+		if got := udpLimit(c.opt, 1232); got != c.want {
+			t.Errorf("udpLimit(%+v) = %d, want %d", c.opt, got, c.want)
+		}
+	}
+}
+
+func TestReplyOPT(t *testing.T) {
+	remote := DNSMsgOPT{UDPSize: 512, ExtRcode: 2, Options: []DNSMsgOption{{Code: 10, Data: []byte{9}}}}
+	m := testLargeMsg("www.ljg.top", 1)
+	m.Add = append(m.Add, remote.toRR())
+	resp := packDNSMsg(m)
+
+	_, rrs := testUnpack(t, replyOPT(resp, nil, 1232))
+	for _, rr := range rrs {
+		if rr.TYPE == typeOPT {
+			t.Error("response to query without OPT should carry no OPT")
+		}
+	}
+
+	got, err := unpackDNSMsg(replyOPT(resp, &DNSMsgOPT{UDPSize: 4096, DO: true}, 1232))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opt, err := findOPT(got)
+	if err != nil || opt == nil {
+		t.Fatalf("response to query with OPT should carry OPT, got %v", err)
+	}
+	if opt.UDPSize != 1232 || !opt.DO || opt.ExtRcode != 2 || !reflect.DeepEqual(opt.Options, remote.Options) {
+		t.Errorf("unexpected OPT in response: %+v", opt)
+	}
+	if len(got.Add) != 2 {
+		t.Errorf("additional section has %d RRs, want 2", len(got.Add))
+	}
+}
+
+func TestTruncateMsgKeepsOPT(t *testing.T) {
+	m := testLargeMsg("www.ljg.top", 40)
+	m.Add = append(m.Add, DNSMsgOPT{UDPSize: 1232}.toRR())
+	got, err := unpackDNSMsg(truncateMsg(packDNSMsg(m), minUDPSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opt, _ := findOPT(got); opt == nil || len(got.Add) != 1 {
+		t.Errorf("truncated message should keep OPT only in additional section, got %+v", got.Add)
+	}
+}
+
+func TestComposeQuery(t *testing.T) {
+	// ARCOUNT of the client's query is never copied blindly
+	hdr := DNSMsgHdr{ID: 1, FLAGS: 0x0100, QDCOUNT: 1, ARCOUNT: 1}
+	qst := DNSMsgQst{QNAME: testQNAME("www.ljg.top"), QTYPE: 1, QCLASS: 1}
+	if !bytes.Equal(composeQuery(hdr, qst, nil)[10:12], []byte{0, 0}) {
+		t.Error("query without OPT should have ARCOUNT 0")
+	}
+	m, err := unpackDNSMsg(composeQuery(hdr, qst, &DNSMsgOPT{UDPSize: 1232, DO: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opt, _ := findOPT(m); opt == nil || opt.UDPSize != 1232 || !opt.DO {
+		t.Errorf("query should carry OPT, got %+v", m.Add)
+	}
+}
+
+func TestHandlerEDNS(t *testing.T) {
+	r := testRelay("10.0.0.1 www.ljg.top")
+	m := testExchange(t, r, testEDNSQuery(1, "www.ljg.top", DNSMsgOPT{UDPSize: 4096, DO: true}))
+	opt, _ := findOPT(m)
+	if len(m.Asr) != 1 || opt == nil || opt.UDPSize != r.cfg.EDNSUDPSize || !opt.DO {
+		t.Errorf("answer from hosts should carry OPT, got %+v", m)
+	}
+
+	m = testExchange(t, r, testEDNSQuery(2, "www.ljg.top", DNSMsgOPT{UDPSize: 4096, Version: 1}))
+	opt, _ = findOPT(m)
+	if opt == nil || int(opt.ExtRcode)<<4|int(m.Hdr.parseFlags().RCODE) != rcodeBadVers || len(m.Asr) != 0 {
+		t.Errorf("query with EDNS version 1 should get BADVERS, got %+v", m)
+	}
+
+	m = testExchange(t, r, testQuery(3, "www.ljg.top"))
+	if opt, _ = findOPT(m); opt != nil || len(m.Asr) != 1 {
+		t.Errorf("query without OPT should get no OPT, got %+v", m)
+	}
+}
@@ -1,3 +1,3 @@
 module github.com/skyleaworlder/DNS-Relay.go
 
-go 1.15
+go 1.21
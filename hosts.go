@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+)
+
+// hostsEntry is a line of hosts file, in the syntax of /etc/hosts:
+// an address followed by a canonical name and optional aliases, such as
+// 127.0.0.1	localhost localhost.localdomain	# comment
+// instead of an address, the first column may be a block mode, such as "refused ads.example.com"
+// ip: IPv4 or IPv6 address; block: block mode, if ip is empty; names: canonical name then aliases;
+// path, line: where the entry comes from, for warnings
+type hostsEntry struct {
+	ip    string
+	block string
+	names []string
+	path  string
+	line  int
+}
+
+// hostsRecord is an address (or a block mode) of a name found in hosts files
+// canonical: the canonical name (first name) of the line, the name looked up may be an alias of it
+type hostsRecord struct {
+	ip        string
+	block     string
+	canonical string
+	path      string
+	line      int
+}
+
+// hostsStore is an index of hosts entries by canonical name (see canonicalName),
+// so a name is looked up in O(1) and case-insensitively, whatever the size of hosts files
+// names: every rule, exact names as well as "*.name" and ".name";
+// patterns: rules of "*.name" and ".name" again, by reversed labels
+type hostsStore struct {
+	names    map[string][]hostsRecord
+	patterns *labelTrie
+}
+
+// hostsMatch is the result of matching a name against hosts
+// rule: the exact name, "*.name" or ".name" which matched
+type hostsMatch struct {
+	rule    string
+	records []hostsRecord
+}
+
+// canonicalName is a function to normalize a domain name before it's indexed or looked up,
+// domain names are case-insensitive, and "www.ljg.top." is the same name as "www.ljg.top"
+// prefixes of "*.name" and ".name" rules are kept
+func canonicalName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// newHostsStore is a function to index entries by name,
+// an address repeated for a name is only kept once, in the order of entries
+func newHostsStore(entries []hostsEntry) *hostsStore {
+	s := &hostsStore{names: make(map[string][]hostsRecord), patterns: newLabelTrie()}
+	for _, entry := range entries {
+		record := hostsRecord{ip: entry.ip, block: entry.block, canonical: entry.names[0], path: entry.path, line: entry.line}
+		for _, name := range entry.names {
+			s.add(canonicalName(name), record)
+		}
+	}
+	for name, records := range s.names {
+		if isPattern(name) {
+			s.patterns.insert(name, records)
+		}
+	}
+	return s
+}
+
+// isPattern is a function to check whether a rule of hosts matches more than one name
+func isPattern(rule string) bool {
+	return strings.HasPrefix(rule, wildcardPrefix) || strings.HasPrefix(rule, zonePrefix)
+}
+
+// add is a function to append record to name unless name already has its address (or block mode)
+func (s *hostsStore) add(name string, record hostsRecord) {
+	for _, r := range s.names[name] {
+		if r.ip == record.ip && r.block == record.block {
+			return
+		}
+	}
+	s.names[name] = append(s.names[name], record)
+}
+
+// lookup is a function to get every record of name listed exactly, nil if name is not in hosts
+func (s *hostsStore) lookup(name string) []hostsRecord {
+	return s.names[canonicalName(name)]
+}
+
+// match is a function to find the rule of hosts for name, the longest match wins:
+// name listed exactly, then "*.suffix" or ".suffix" rules of the longest suffix of name
+func (s *hostsStore) match(name string) (m hostsMatch, ok bool) {
+	name = canonicalName(name)
+	if records, found := s.names[name]; found && !isPattern(name) {
+		return hostsMatch{rule: name, records: records}, true
+	}
+	m.rule, m.records, ok = s.patterns.match(name)
+	return
+}
+
+// len is a function to get the number of names in s
+func (s *hostsStore) len() int {
+	return len(s.names)
+}
+
+// initDNSHosts is a func to generate hosts store
+// this func read hosts files in paths as far as possible, main uses loadDNSHosts to fail fast instead
+// malformed lines and unreadable files are skipped with warnings on stderr
+func initDNSHosts(paths []string) (hosts *hostsStore) {
+	var entries []hostsEntry
+	for _, path := range paths {
+		fileEntries, warnings, err := readDNSHosts(path)
+		for _, warning := range warnings {
+			msg, attrs := lineWarning(warning)
+			slog.Warn(msg, attrs...)
+		}
+		if err != nil {
+			slog.Warn("skip hosts file", "err", err)
+			continue
+		}
+		entries = append(entries, fileEntries...)
+	}
+	return newHostsStore(entries)
+}
+
+// loadDNSHosts is a func to read every hosts file in paths into a new hosts store
+// unlike initDNSHosts, it fails if any file can't be read, warnings are returned to caller
+func loadDNSHosts(paths []string) (hosts *hostsStore, warnings []string, err error) {
+	var entries []hostsEntry
+	for _, path := range paths {
+		fileEntries, fileWarnings, err := readDNSHosts(path)
+		warnings = append(warnings, fileWarnings...)
+		if err != nil {
+			return nil, warnings, err
+		}
+		entries = append(entries, fileEntries...)
+	}
+	return newHostsStore(entries), warnings, nil
+}
+
+// readDNSHosts is a func to read a single hosts file
+func readDNSHosts(path string) (entries []hostsEntry, warnings []string, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+	return parseHosts(file, path)
+}
+
+// parseHosts is a function to parse hosts file content read from rd
+// fields are separated by tabs or runs of spaces, '#' begins a comment till the end of line,
+// blank lines are ignored; a line with a bad address or a bad name yields a warning
+// prefixed by path:line, while valid names on it are still kept
+func parseHosts(rd io.Reader, path string) (entries []hostsEntry, warnings []string, err error) {
+	scanner := bufio.NewScanner(rd)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		warnf := func(format string, a ...interface{}) {
+			warnings = append(warnings, fmt.Sprintf("%s:%d: ", path, lineNo)+fmt.Sprintf(format, a...))
+		}
+
+		entry := hostsEntry{ip: fields[0], path: path, line: lineNo}
+		if mode := strings.ToLower(fields[0]); isBlockMode(mode) {
+			entry.ip, entry.block = "", mode
+		} else if net.ParseIP(fields[0]) == nil {
+			warnf("invalid address %q", fields[0])
+			continue
+		}
+		if len(fields) == 1 {
+			warnf("no name for address %s", fields[0])
+			continue
+		}
+		for _, name := range fields[1:] {
+			if err := checkHostName(name); err != nil {
+				warnf("invalid name %q: %s", name, err.Error())
+				continue
+			}
+			entry.names = append(entry.names, strings.TrimSuffix(name, "."))
+		}
+		if len(entry.names) > 0 {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, warnings, scanner.Err()
+}
+
+// checkHostName is a function to check whether name from hosts file is a valid domain name,
+// a single trailing dot is allowed, as well as a leading "*." (wildcard) or "." (zone)
+func checkHostName(name string) error {
+	name = strings.TrimSuffix(name, ".")
+	if strings.HasPrefix(name, wildcardPrefix) {
+		name = name[len(wildcardPrefix):]
+	} else if strings.HasPrefix(name, zonePrefix) {
+		name = name[len(zonePrefix):]
+	}
+	if name == "" {
+		return errors.New("empty name")
+	}
+	// 253 characters in text, 255 octets in wire format
+	if len(name) > maxNameLen-2 {
+		return errLongName
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" {
+			return errors.New("empty label")
+		}
+		if len(label) > maxLabelLen {
+			return errBadLabel
+		}
+		if strings.Contains(label, "*") {
+			return errors.New("wildcard is only allowed as leading \"*.\"")
+		}
+	}
+	return nil
+}
+
+// findDomainName is a function that draws ip address from hosts using a given domainName
+// if not found, return a string whose length equals 0, and error
+// if found, return ip address from hosts and nil
+func getIPAddrByDomainName(hosts *hostsStore, domainNameInput string) (ip string, err error) {
+	if ips, _ := getIPAddrsByDomainName(hosts, domainNameInput); len(ips) > 0 {
+		return ips[0], nil
+	}
+	return "", errors.New("DNS-Relay> Cache Not Found")
+}
+
+// getIPAddrsByDomainName is a function that draws every ip address (IPv4 and IPv6) of domainName from hosts
+// domainName is case-insensitive, ips are in the order of hosts files; nil is returned if not found
+// rule is the exact name, wildcard or zone of hosts which matched, see hostsStore.match
+func getIPAddrsByDomainName(hosts *hostsStore, domainNameInput string) (ips []string, rule string) {
+	m, ok := hosts.match(domainNameInput)
+	if !ok {
+		return nil, ""
+	}
+	for _, record := range m.records {
+		if record.ip != "" {
+			ips = append(ips, record.ip)
+		}
+	}
+	return ips, m.rule
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParseHosts(t *testing.T) {
+	content := strings.Join([]string{
+		"# comment line",
+		"",
+		"127.0.0.1\tlocalhost localhost.localdomain   # trailing comment",
+		"  10.0.0.1    www.ljg.top. ljg.top",
+		"10.0.0.2 www.ljg.top",
+		"::1\t\tip6-localhost ip6-loopback",
+		"10.0.0.300 bad.address",
+		"10.0.0.3",
+		"10.0.0.4 bad..name good.name",
+		"   \t  ",
+	}, "\n")
+	entries, warnings, err := parseHosts(strings.NewReader(content), "test.hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []hostsEntry{
+		{ip: "127.0.0.1", names: []string{"localhost", "localhost.localdomain"}, path: "test.hosts", line: 3},
+		{ip: "10.0.0.1", names: []string{"www.ljg.top", "ljg.top"}, path: "test.hosts", line: 4},
+		{ip: "10.0.0.2", names: []string{"www.ljg.top"}, path: "test.hosts", line: 5},
+		{ip: "::1", names: []string{"ip6-localhost", "ip6-loopback"}, path: "test.hosts", line: 6},
+		{ip: "10.0.0.4", names: []string{"good.name"}, path: "test.hosts", line: 9},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("parsed %+v, want %+v", entries, want)
+	}
+
+	wantWarnings := []string{"test.hosts:7:", "test.hosts:8:", "test.hosts:9:"}
+	if len(warnings) != len(wantWarnings) {
+		t.Fatalf("got warnings %q, want %d of them", warnings, len(wantWarnings))
+	}
+	for i, prefix := range wantWarnings {
+		if !strings.HasPrefix(warnings[i], prefix) {
+			t.Errorf("warning %q should begin with %q", warnings[i], prefix)
+		}
+	}
+
+	hosts := newHostsStore(entries)
+	if ips, _ := getIPAddrsByDomainName(hosts, "www.ljg.top"); !reflect.DeepEqual(ips, []string{"10.0.0.1", "10.0.0.2"}) {
+		t.Errorf("www.ljg.top maps to %v, want both addresses", ips)
+	}
+	if ips, _ := getIPAddrsByDomainName(hosts, "localhost.localdomain"); !reflect.DeepEqual(ips, []string{"127.0.0.1"}) {
+		t.Errorf("alias localhost.localdomain maps to %v", ips)
+	}
+}
+
+func TestHostsStore(t *testing.T) {
+	entries, _, _ := parseHosts(strings.NewReader(strings.Join([]string{
+		"0.0.0.0 www.Baidu.com",
+		"10.0.0.1 www.ljg.top ljg.top",
+		"10.0.0.1 WWW.LJG.TOP",
+		"2001:db8::1 www.ljg.top",
+	}, "\n")), "test.hosts")
+	hosts := newHostsStore(entries)
+	if hosts.len() != 3 {
+		t.Errorf("store has %d names, want 3", hosts.len())
+	}
+
+	for _, name := range []string{"www.baidu.com", "WWW.Baidu.com", "www.baidu.com."} {
+		if ips, _ := getIPAddrsByDomainName(hosts, name); !reflect.DeepEqual(ips, []string{"0.0.0.0"}) {
+			t.Errorf("%s maps to %v, want [0.0.0.0]", name, ips)
+		}
+	}
+
+	records := hosts.lookup("Www.Ljg.Top")
+	if len(records) != 2 || records[0].ip != "10.0.0.1" || records[1].ip != "2001:db8::1" {
+		t.Fatalf("www.ljg.top has records %+v, want 10.0.0.1 once and 2001:db8::1", records)
+	}
+	if records[0].line != 2 || records[0].path != "test.hosts" {
+		t.Errorf("record should come from test.hosts:2, got %+v", records[0])
+	}
+	if alias := hosts.lookup("ljg.top"); len(alias) != 1 || alias[0].canonical != "www.ljg.top" {
+		t.Errorf("alias ljg.top should report canonical name www.ljg.top, got %+v", alias)
+	}
+	if hosts.lookup("www.ljg.top.cn") != nil {
+		t.Error("name not in hosts should have no record")
+	}
+}
+
+// testLargeHosts generate hosts file content of n names, one per line
+func testLargeHosts(n int) string {
+	var sb strings.Builder
+	for i := 0; i < n; i++ {
+		sb.WriteString("0.0.0.0 ad")
+		sb.WriteString(strconv.Itoa(i))
+		sb.WriteString(".tracker.example.com\n")
+	}
+	return sb.String()
+}
+
+func BenchmarkHostsStoreLookup(b *testing.B) {
+	entries, _, _ := parseHosts(strings.NewReader(testLargeHosts(1000000)), "bench.hosts")
+	hosts := newHostsStore(entries)
+	names := []string{"ad999999.tracker.example.com", "AD500000.Tracker.Example.com", "www.ljg.top"}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		hosts.lookup(names[i%len(names)])
+	}
+}
+
+func BenchmarkHostsStoreBuild(b *testing.B) {
+	content := testLargeHosts(1000000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		entries, _, _ := parseHosts(strings.NewReader(content), "bench.hosts")
+		newHostsStore(entries)
+	}
+}
@@ -0,0 +1,73 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// inotifyMask is events of a directory which may change a hosts file in it,
+// directories are watched instead of files, since editors often replace a file by renaming another onto it
+const inotifyMask = syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_MOVED_FROM |
+	syscall.IN_CREATE | syscall.IN_DELETE
+
+// watchInotify is a function to call notify once any file in paths changes, until stop is closed
+// err is returned at once if inotify can't be set up, so caller may fall back to polling
+func watchInotify(paths []string, stop <-chan struct{}, notify func()) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return err
+	}
+	files := make(map[string]bool)
+	dirs := make(map[int32]string)
+	for _, path := range paths {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			syscall.Close(fd)
+			return err
+		}
+		files[abs] = true
+		wd, err := syscall.InotifyAddWatch(fd, filepath.Dir(abs), inotifyMask)
+		if err != nil {
+			syscall.Close(fd)
+			return err
+		}
+		// a directory watched twice gets the same wd
+		dirs[int32(wd)] = filepath.Dir(abs)
+	}
+
+	// a non-blocking fd is read through the runtime poller, so Close wakes up the pending Read
+	file := os.NewFile(uintptr(fd), "inotify")
+	go func() {
+		<-stop
+		file.Close()
+	}()
+	go func() {
+		buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+		for {
+			n, err := file.Read(buf)
+			if err != nil {
+				return
+			}
+			for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+				event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+				begin := offset + syscall.SizeofInotifyEvent
+				end := begin + int(event.Len)
+				if end > n {
+					break
+				}
+				name := strings.TrimRight(string(buf[begin:end]), "\x00")
+				if files[filepath.Join(dirs[event.Wd], name)] {
+					notify()
+				}
+				offset = end
+			}
+		}
+	}()
+	return nil
+}
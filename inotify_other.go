@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+// errNoInotify is returned by watchInotify where inotify is not available
+var errNoInotify = errors.New("inotify is only available on linux")
+
+// watchInotify is a function to watch files by inotify, which only exists on linux,
+// caller falls back to polling
+func watchInotify(paths []string, stop <-chan struct{}, notify func()) error {
+	return errNoInotify
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+)
+
+// log formats of config
+const (
+	logText = "text"
+	logJSON = "json"
+)
+
+// decisions of handler, how a query is answered
+// hosts: by hosts files; blocked: by block mode, for hosts files or blocklists;
+// forwarded: by remote DNS; cached: by cache of answers from remote DNS;
+// rejected: by an error without looking the name up, such as BADVERS to an unsupported EDNS version or REFUSED to a class other than IN
+const (
+	decisionHosts     = "hosts"
+	decisionBlocked   = "blocked"
+	decisionForwarded = "forwarded"
+	decisionCached    = "cached"
+	decisionRejected  = "rejected"
+)
+
+// newLogger is a function to create a logger writing records of level or above to w,
+// format is "text" (key=value pairs) or "json" (an object per line)
+func newLogger(w io.Writer, format string, level slog.Level) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: level}
+	if format == logJSON {
+		return slog.New(slog.NewJSONHandler(w, opts))
+	}
+	return slog.New(slog.NewTextHandler(w, opts))
+}
+
+// parseLogLevel is a function to read a level of "debug", "info", "warn" or "error", case-insensitive
+func parseLogLevel(s string) (level slog.Level, err error) {
+	err = level.UnmarshalText([]byte(s))
+	return
+}
+
+// rcodeNames are mnemonics of RCODE, RFC-1035, and of extended RCODE, RFC-6891
+var rcodeNames = map[uint16]string{
+	0:  "NOERROR",
+	1:  "FORMERR",
+	2:  "SERVFAIL",
+	3:  "NXDOMAIN",
+	4:  "NOTIMP",
+	5:  "REFUSED",
+	16: "BADVERS",
+}
+
+// rcodeName is a function to get the mnemonic of rcode, or its number if unknown
+func rcodeName(rcode uint16) string {
+	if name, ok := rcodeNames[rcode]; ok {
+		return name
+	}
+	return strconv.Itoa(int(rcode))
+}
+
+// respRcode is a function to get RCODE of a response, extended by EXTENDED-RCODE of its OPT if there's one
+func respRcode(resp []byte) uint16 {
+	hdr, err := parseDNSHdr(resp)
+	if err != nil {
+		return 0
+	}
+	rcode := uint16(hdr.parseFlags().RCODE)
+	if hdr.ARCOUNT == 0 {
+		return rcode
+	}
+	m, err := unpackDNSMsg(resp)
+	if err != nil {
+		return rcode
+	}
+	if opt, err := findOPT(m); err == nil && opt != nil {
+		rcode |= uint16(opt.ExtRcode) << 4
+	}
+	return rcode
+}
+
+// qtypeNames are mnemonics of common QTYPE
+var qtypeNames = map[uint16]string{
+	1:       "A",
+	2:       "NS",
+	5:       "CNAME",
+	6:       "SOA",
+	12:      "PTR",
+	15:      "MX",
+	16:      "TXT",
+	28:      "AAAA",
+	33:      "SRV",
+	typeOPT: "OPT",
+	64:      "SVCB",
+	65:      "HTTPS",
+	255:     "ANY",
+}
+
+// qtypeName is a function to get the mnemonic of qtype, or "TYPE<number>" if unknown, RFC-3597
+func qtypeName(qtype uint16) string {
+	if name, ok := qtypeNames[qtype]; ok {
+		return name
+	}
+	return "TYPE" + strconv.Itoa(int(qtype))
+}
+
+// lineWarning is a function to split a warning of parseHosts or parseBlocklist, "path:line: message",
+// into attributes of a log record
+func lineWarning(warning string) (msg string, attrs []any) {
+	i := strings.Index(warning, ": ")
+	if i < 0 {
+		return warning, nil
+	}
+	return warning[i+2:], []any{"at", warning[:i]}
+}
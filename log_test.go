@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestNewLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := newLogger(&buf, logJSON, slog.LevelInfo)
+	logger.Debug("hidden")
+	logger.Info("shown", "qname", "www.ljg.top")
+	var record map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("%s is not a JSON record: %v", buf.String(), err)
+	}
+	if record["msg"] != "shown" || record["qname"] != "www.ljg.top" || record["level"] != "INFO" {
+		t.Errorf("unexpected record %v", record)
+	}
+
+	buf.Reset()
+	newLogger(&buf, logText, slog.LevelWarn).Info("hidden")
+	if buf.Len() != 0 {
+		t.Errorf("info is logged at level warn: %s", buf.String())
+	}
+}
+
+func TestHandlerLog(t *testing.T) {
+	var buf bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(newLogger(&buf, logJSON, slog.LevelDebug))
+
+	r := testRelay("10.0.0.1 www.ljg.top\n0.0.0.0 ads.ljg.top\n")
+	testExchange(t, r, testQuery(1, "www.ljg.top"))
+	testExchange(t, r, composeHdrQst(DNSMsgHdr{ID: 2, FLAGS: 0x0100, QDCOUNT: 1},
+		DNSMsgQst{QNAME: testQNAME("ads.ljg.top"), QTYPE: 28, QCLASS: 1}))
+
+	var answered []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("%s is not a JSON record: %v", line, err)
+		}
+		if record["msg"] == "query answered" {
+			answered = append(answered, record)
+		}
+	}
+	want := []map[string]string{
+		{"qname": "www.ljg.top", "qtype": "A", "rcode": "NOERROR", "decision": decisionHosts, "proto": "tcp"},
+		{"qname": "ads.ljg.top", "qtype": "AAAA", "rcode": "NXDOMAIN", "decision": decisionBlocked, "proto": "tcp"},
+	}
+	if len(answered) != len(want) {
+		t.Fatalf("%d queries logged, want %d: %s", len(answered), len(want), buf.String())
+	}
+	for i, fields := range want {
+		for key, value := range fields {
+			if answered[i][key] != value {
+				t.Errorf("query %d: %s is %v, want %s", i, key, answered[i][key], value)
+			}
+		}
+		if _, ok := answered[i]["latency"]; !ok {
+			t.Errorf("query %d: no latency", i)
+		}
+	}
+}
+
+func TestLoadConfigLog(t *testing.T) {
+	cfg, err := loadConfig([]string{"-log-level", "WARN", "-log-format", "JSON"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.logLevel() != slog.LevelWarn || cfg.LogFormat != logJSON {
+		t.Errorf("log level %s, format %s", cfg.logLevel(), cfg.LogFormat)
+	}
+	if cfg, _ = loadConfig([]string{"-log-level", "error", "-verbose"}); cfg.logLevel() != slog.LevelDebug {
+		t.Errorf("verbose should log at debug level, not %s", cfg.logLevel())
+	}
+	for _, args := range [][]string{{"-log-level", "trace"}, {"-log-format", "xml"}} {
+		if _, err := loadConfig(args); err == nil {
+			t.Errorf("config %v should be rejected", args)
+		}
+	}
+}
@@ -1,16 +1,20 @@
 package main
 
 import (
-	"bufio"
+	"context"
 	"encoding/binary"
 	"errors"
+	"flag"
 	"fmt"
-	"io"
+	"log/slog"
 	"net"
 	"os"
-	"strconv"
+	"os/signal"
+	"runtime/debug"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 )
 
 // DNSMsgHdr is a struct of DNS MESSAGE Header Format
@@ -157,18 +161,20 @@ func (msg DNSMsgHdr) parseFlags() (flags DNSMsgFlags) {
 // parseDomainName is a func that draw domain name(string) from struct DNSMsgQst
 // e.g. 0x06, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x03, 0x63, 0x6f, 0x6d, 0x00
 // 		will be translated into "google.com"
+// a malformed QNAME is translated as far as it is valid
 func (qst DNSMsgQst) parseDomainName() (domainName string) {
 	domainName = ""
 	qname := qst.QNAME
-	for i := 0; qname[i] != 0; {
+	for i := 0; i < len(qname) && qname[i] != 0; {
 		domainLen := int(qname[i])
 		// since length of domain name also occupies an octet
 		// for example, "google.com":
 		// i++ make j begin at domain name 'g' or 'c', instead of length '0x06' or '0x03'
 		i++
-		for j := 0; j < domainLen; j++ {
-			domainName += string(qname[i+j])
+		if domainLen > maxLabelLen || i+domainLen > len(qname) {
+			break
 		}
+		domainName += string(qname[i : i+domainLen])
 		// it has to be NOTICED that "google.com" will be translated into "google.com."
 		domainName += "."
 		i += domainLen
@@ -177,7 +183,12 @@ func (qst DNSMsgQst) parseDomainName() (domainName string) {
 	return strings.Trim(domainName, ".")
 }
 
-func parseDNSHdr(msg []byte) (dnsMsgHdr DNSMsgHdr) {
+// parseDNSHdr is a func to draw Header field from DNS MESSAGE
+// Header is always 12 octets, a shorter msg is an error
+func parseDNSHdr(msg []byte) (dnsMsgHdr DNSMsgHdr, err error) {
+	if len(msg) < 12 {
+		return dnsMsgHdr, errShortMsg
+	}
 	id := binary.BigEndian.Uint16(msg[0:2])
 	flags := binary.BigEndian.Uint16(msg[2:4])
 	qdcount := binary.BigEndian.Uint16(msg[4:6])
@@ -201,13 +212,30 @@ func parseDNSHdr(msg []byte) (dnsMsgHdr DNSMsgHdr) {
 // || 06 | 67 6f 6f 67 6c 65 || 03 | 63 6f 6d || 00 ||
 // |-len-|-------google------|-len-|----com----|-00-|
 // so the last octet, namely, "00" will be a separator between QNAME and QTYPE
-func parseDNSQst(msg []byte) (dnsMsgQst DNSMsgQst, length uint16) {
+// QNAME of a question is never compressed, labels over 63 octets or names over
+// 255 octets are errors, as well as a msg ending before QCLASS
+func parseDNSQst(msg []byte) (dnsMsgQst DNSMsgQst, length uint16, err error) {
 	i := 0
-	for msg[i] != 0 {
-		i = i + 1
+	for {
+		if i >= len(msg) {
+			return dnsMsgQst, 0, errShortMsg
+		}
+		if msg[i] == 0 {
+			break
+		}
+		if msg[i] > maxLabelLen {
+			return dnsMsgQst, 0, errBadLabel
+		}
+		i += int(msg[i]) + 1
+		if i+1 > maxNameLen {
+			return dnsMsgQst, 0, errLongName
+		}
 	}
 	// [0:i+2], as for "google.com", i = 11
 	// but 06 67 6f 6f 67 6c 65 03 63 6f 6d 00, i should be 12
+	if i+5 > len(msg) {
+		return dnsMsgQst, 0, errShortMsg
+	}
 	qname := msg[0 : i+1]
 	qtype := binary.BigEndian.Uint16(msg[i+1 : i+3])
 	qclass := binary.BigEndian.Uint16(msg[i+3 : i+5])
@@ -221,18 +249,27 @@ func parseDNSQst(msg []byte) (dnsMsgQst DNSMsgQst, length uint16) {
 
 // parseDNSRequest is a tool function that handle DNS Request MESSAGE
 // translate octet-stream to struct DNSMsgHdr/DNSMsgQst defined in RFC-1035
-func parseDNSRequest(msg []byte) (dnsMsgHdr DNSMsgHdr, dnsMsgQst DNSMsgQst, length uint16) {
-	hdr := msg[0:12]
-	dnsMsgHdr = parseDNSHdr(hdr)
+// a msg without question is an error
+func parseDNSRequest(msg []byte) (dnsMsgHdr DNSMsgHdr, dnsMsgQst DNSMsgQst, length uint16, err error) {
+	if dnsMsgHdr, err = parseDNSHdr(msg); err != nil {
+		return
+	}
+	if dnsMsgHdr.QDCOUNT == 0 {
+		return dnsMsgHdr, dnsMsgQst, 0, errNoQuestion
+	}
 	qst := msg[12:]
-	dnsMsgQst, qstLen := parseDNSQst(qst)
+	dnsMsgQst, qstLen, err := parseDNSQst(qst)
+	if err != nil {
+		return
+	}
 	length = qstLen + 12
 	return
 }
 
 // createDNSMsgRR is a function to construct DNSMsgRR
 // this Resource Record is Answer
-// asrRData is Address or CName, but in my dns relay, it's only Address
+// asrRData is Address or CName, but in my dns relay, it's only Address:
+// IPv4 for A(1), 4 octets, which may be written IPv4-mapped such as ::ffff:10.1.2.3; or IPv6 for AAAA(28), 16 octets
 func createDNSMsgAsr(asrType uint16, asrClass uint16, asrTTL uint32, asrRDLength uint16, asrRData string) (asr DNSMsgRR) {
 	asr.NAME = []byte{0xc0, 0x0c}
 	asr.TYPE = asrType
@@ -240,16 +277,58 @@ func createDNSMsgAsr(asrType uint16, asrClass uint16, asrTTL uint32, asrRDLength
 	asr.TTL = asrTTL
 	asr.RDLENGTH = asrRDLength
 
-	// Dotted Decimal Notation
-	address := strings.Split(asrRData, ".")
-	for _, octet := range address {
-		// in fact, bitSize(parameter) of ParseInt indicates the size of return value
-		I, _ := strconv.ParseInt(octet, 10, 9)
-		asr.RDATA = append(asr.RDATA, byte(I))
+	if asrType == 28 {
+		asr.RDATA = append(asr.RDATA, net.ParseIP(asrRData).To16()...)
+		return
 	}
+	asr.RDATA = append(asr.RDATA, net.ParseIP(asrRData).To4()...)
 	return
 }
 
+// isIPv4 is a function to check whether ip from hosts is an IPv4 address, answered by A(1) instead of AAAA(28)
+func isIPv4(ip string) bool {
+	addr := net.ParseIP(ip)
+	return addr != nil && addr.To4() != nil
+}
+
+// isLocalClass is a function to check whether names of class QCLASS can be answered,
+// hosts only holds IN(1) data, ANY(255) included, and other classes are refused instead of forwarded
+func isLocalClass(qclass uint16) bool {
+	return qclass == 1 || qclass == 255
+}
+
+// localRRs is a function to synthesize RRs of the type asked by qst.QTYPE from ips found in hosts
+// hosts only holds addresses: A(1) from IPv4, AAAA(28) from IPv6, and both for ANY(255),
+// nothing is synthesized for other types (MX, TXT, SRV, HTTPS...)
+func localRRs(qst DNSMsgQst, ips []string, ttl uint32) (rrs []DNSMsgRR) {
+	for _, ip := range ips {
+		v4 := isIPv4(ip)
+		switch {
+		case v4 && (qst.QTYPE == 1 || qst.QTYPE == 255):
+			rrs = append(rrs, createDNSMsgAsr(1, 1, ttl, 4, ip))
+		case !v4 && net.ParseIP(ip) != nil && (qst.QTYPE == 28 || qst.QTYPE == 255):
+			rrs = append(rrs, createDNSMsgAsr(28, 1, ttl, 16, ip))
+		}
+	}
+	return
+}
+
+// respFlags is a function to generate FLAGS of a response to a query with header hdr
+// Opcode and RD are copied from the query, QR and RA are set
+func respFlags(hdr DNSMsgHdr, rcode uint16) uint16 {
+	return 0x8080 | hdr.FLAGS&0x7900 | rcode
+}
+
+// composeAddrs is a function to generate a response to query (hdr, qst) answered by ips from hosts
+// only RRs of the type asked by qst.QTYPE are answered, see localRRs, and the response is
+// NODATA (NOERROR without answer) if the name has no data of that type, such as MX, or only the other family
+// header counts always follow the sections
+func composeAddrs(hdr DNSMsgHdr, qst DNSMsgQst, ips []string, ttl uint32) []byte {
+	m := DNSMsg{Hdr: DNSMsgHdr{ID: hdr.ID, FLAGS: respFlags(hdr, 0)}, Qst: []DNSMsgQst{qst}}
+	m.Asr = localRRs(qst, ips, ttl)
+	return packDNSMsg(m)
+}
+
 // composeHdrQst is a function to compose struct DNSMsgHdr and DNSMsgQst
 // this function aims at reusing some code and creating DNS Relay MESSAGE
 func composeHdrQst(hdr DNSMsgHdr, qst DNSMsgQst) (relay []byte) {
@@ -284,103 +363,125 @@ func composeHdrQst(hdr DNSMsgHdr, qst DNSMsgQst) (relay []byte) {
 	return
 }
 
-// composeHdrQstAsr is a function to generate a response to DNS query initiator
-// using Header, Question and single Resource Record field to pack an DNS MESSAGE
-func composeHdrQstAsr(hdr DNSMsgHdr, qst DNSMsgQst, asr DNSMsgRR) (resp []byte) {
-	// compose struct DNSMsgHdr and DNSMsgQst
-	resp = composeHdrQst(hdr, qst)
+// composeQuery is a function to generate a query towards remote DNS from hdr and qst,
+// with opt in additional section if it's not nil, header counts follow the sections
+func composeQuery(hdr DNSMsgHdr, qst DNSMsgQst, opt *DNSMsgOPT) []byte {
+	m := DNSMsg{Hdr: hdr, Qst: []DNSMsgQst{qst}}
+	if opt != nil {
+		m.Add = []DNSMsgRR{opt.toRR()}
+	}
+	return packDNSMsg(m)
+}
 
-	// DNS Message Answer field
-	AsrName := asr.NAME
-	AsrType := make([]byte, 2)
-	AsrClass := make([]byte, 2)
-	AsrTTL := make([]byte, 4)
-	AsrDataLength := make([]byte, 2)
-	AsrAddress := asr.RDATA
-	binary.BigEndian.PutUint16(AsrType, asr.TYPE)
-	binary.BigEndian.PutUint16(AsrClass, asr.CLASS)
-	binary.BigEndian.PutUint32(AsrTTL, asr.TTL)
-	binary.BigEndian.PutUint16(AsrDataLength, asr.RDLENGTH)
+// composeRR is a function to translate a single Resource Record into octets
+func composeRR(rr DNSMsgRR) (octets []byte) {
+	RRName := rr.NAME
+	RRType := make([]byte, 2)
+	RRClass := make([]byte, 2)
+	RRTTL := make([]byte, 4)
+	RRDataLength := make([]byte, 2)
+	RRData := rr.RDATA
+	binary.BigEndian.PutUint16(RRType, rr.TYPE)
+	binary.BigEndian.PutUint16(RRClass, rr.CLASS)
+	binary.BigEndian.PutUint32(RRTTL, rr.TTL)
+	binary.BigEndian.PutUint16(RRDataLength, rr.RDLENGTH)
 
 	fields := [][]byte{
-		AsrName, AsrType, AsrClass, AsrTTL, AsrDataLength, AsrAddress,
+		RRName, RRType, RRClass, RRTTL, RRDataLength, RRData,
 	}
 	for _, v := range fields {
-		resp = append(resp, v...)
+		octets = append(octets, v...)
 	}
 	return
 }
 
-// composeHdrQstMultiRR is a simple function to comcat hdr, qst and multi-RR
-func composeHdrQstMultiRR(hdr DNSMsgHdr, qst DNSMsgQst, rr []byte) (resp []byte) {
-	resp = composeHdrQst(hdr, qst)
-	resp = append(resp, rr...)
-	return
+// composeFormErr is a function to generate a FORMERR response to a malformed query
+// the question can't be trusted, so response carries the header only
+func composeFormErr(hdr DNSMsgHdr) []byte {
+	// keep Opcode and RD, RCODE(1) means format error
+	respHdr := DNSMsgHdr{ID: hdr.ID, FLAGS: 0x8000 | hdr.FLAGS&0x7900 | 1}
+	return packDNSMsg(DNSMsg{Hdr: respHdr})
 }
 
-func checkError(successInfo string, err error, debug bool) bool {
-	if err != nil && debug {
-		fmt.Fprintf(os.Stderr, "DNS-Relay> Error occur: %s\n", err.Error())
-		os.Exit(1)
-	} else if debug {
-		fmt.Printf("DNS-Relay> Success: %s\n", successInfo)
-		return true
-	}
-	return false
+// composeNotImp is a function to generate a NOTIMP response to a query whose Opcode is not QUERY(0)
+// sections of other Opcodes, such as the zone of UPDATE, are not understood, so response carries the header only
+func composeNotImp(hdr DNSMsgHdr) []byte {
+	// keep Opcode and RD, RCODE(4) means not implemented
+	respHdr := DNSMsgHdr{ID: hdr.ID, FLAGS: 0x8000 | hdr.FLAGS&0x7900 | 4}
+	return packDNSMsg(DNSMsg{Hdr: respHdr})
 }
 
-// initDNSHosts is a func to generate hosts map
-// this func read "hosts" to initialize hosts and return map to main_func
-func initDNSHosts() (hosts map[string]string) {
-	file, err := os.Open("hosts")
-	checkError("open hosts config success", err, false)
-	defer file.Close()
+// composeHdrQstAsr is a function to generate a response to DNS query initiator
+// using Header, Question and single Resource Record field to pack an DNS MESSAGE
+func composeHdrQstAsr(hdr DNSMsgHdr, qst DNSMsgQst, asr DNSMsgRR) (resp []byte) {
+	// compose struct DNSMsgHdr and DNSMsgQst
+	resp = composeHdrQst(hdr, qst)
 
-	rd := bufio.NewReader(file)
-	hosts = make(map[string]string)
-	for {
-		line, err := rd.ReadString('\n')
-		if err == io.EOF {
-			break
-		}
-		checkError("read hosts config success", err, false)
-		// trim \n
-		dnsHostsLineArr := strings.Split(strings.Trim(line, "\n"), " ")
-		// string.Split get a slice: [ip, ' ', ' ', ' ', ..., domainName]
-		// len(slice)-1 to get the last element of slice
-		hosts[dnsHostsLineArr[0]] = dnsHostsLineArr[len(dnsHostsLineArr)-1]
-	}
+	// DNS Message Answer field
+	resp = append(resp, composeRR(asr)...)
 	return
 }
 
-// findDomainName is a function that draws ip address from hosts map using a given domainName
-// if not found, return a string whose length equals 0, and error
-// if found, return ip address from map and nil
-func getIPAddrByDomainName(hosts map[string]string, domainNameInput string) (ip string, err error) {
-	for ip, domainName := range hosts {
-		if domainName == domainNameInput {
-			return ip, nil
-		}
+// composeRcode is a function to generate a response without any RR to query (hdr, qst)
+// rcode: 0 -> no error; 1 -> format error; 2 -> server failure; 3 -> name error; 5 -> refused
+func composeRcode(hdr DNSMsgHdr, qst DNSMsgQst, rcode uint16) (resp []byte) {
+	respHdr := DNSMsgHdr{
+		ID: hdr.ID, FLAGS: respFlags(hdr, rcode),
+		QDCOUNT: 1,
 	}
-	return "", errors.New("DNS-Relay> Cache Not Found")
+	return composeHdrQst(respHdr, qst)
+}
+
+// retryPolicy tells communicateWithForwardDNS how to retry a query unanswered by remote DNS
+// timeout: how long to wait for each attempt
+// retries: attempts after the first one
+// backoff: pause before the first retry, doubled before each following retry
+// otherUpstream: whether a retry prefers a remote DNS not tried yet
+type retryPolicy struct {
+	timeout       time.Duration
+	retries       int
+	backoff       time.Duration
+	otherUpstream bool
 }
 
 // communicateWithForwardDNS is a function to send&recv Msg to&from remote DNS
-// NOTICE: conn is a parameter that specifies remote DNS ip address
-func communicateWithForwardDNS(conn *net.UDPConn, hdr DNSMsgHdr, qst DNSMsgQst) (resp []byte) {
-	// use different DNS ID
-	resp = make([]byte, 256)
-	hdr.ID++
-	relay := composeHdrQst(hdr, qst)
-	_, err := conn.Write(relay)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "UDPConn send msg failed: %s\n", err.Error())
-	}
-	_, err = conn.Read(resp)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "UDPConn recv msg failed: %s\n", err.Error())
+// NOTICE: pool picks a healthy remote DNS, whose mux multiplexes all queries over its connection,
+// the reply returned carries the ID of the original query (hdr.ID) again
+// a query is retried by policy, err is returned once all attempts fail
+// opt is forwarded in additional section if it's not nil, see forwardOPT; addr is the remote DNS which answered
+func communicateWithForwardDNS(pool *upstreamPool, hdr DNSMsgHdr, qst DNSMsgQst, opt *DNSMsgOPT, policy retryPolicy) (resp []byte, addr string, err error) {
+	var tried []*upstream
+	backoff := policy.backoff
+	for attempt := 0; attempt <= policy.retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		var u *upstream
+		if attempt > 0 {
+			relayMetrics.retries.Add(1)
+		}
+		start := time.Now()
+		if policy.otherUpstream {
+			resp, u, err = pool.exchange(hdr, qst, opt, policy.timeout, tried...)
+		} else {
+			resp, u, err = pool.exchange(hdr, qst, opt, policy.timeout)
+		}
+		if u != nil {
+			relayMetrics.upstream(u.addr, time.Since(start), err)
+		}
+		if err == nil {
+			binary.BigEndian.PutUint16(resp[0:2], hdr.ID)
+			return resp, u.addr, nil
+		}
+		if u == nil {
+			// no remote DNS to retry with
+			return nil, "", err
+		}
+		slog.Warn("exchange with remote DNS failed", "upstream", u.addr, "attempt", attempt+1, "err", err)
+		tried = append(tried, u)
 	}
-	return
+	return nil, "", err
 }
 
 // safeBuf is a struct contain sync.Mutex to ensure the safety of buffer
@@ -389,86 +490,260 @@ type safeBuf struct {
 	mtx sync.Mutex
 }
 
-// DNSRelay is the main function
-func DNSRelay(hosts map[string]string) {
+// relay is a struct of everything shared by handler goroutines
+// cfg: from loadConfig;
+// hosts: from newHostsTable, domain names answered locally, reloaded once hosts files change;
+// blocks: from initBlocklists, names blocked besides hosts files;
+// allow: from newAllowlist, names never blocked;
+// cache: from newAnswerCache, answers from remote DNS;
+// pool: from dialUpstreamPool, remote DNS queries are forwarded to;
+// queryLog: from newQueryLog, every query is recorded in it, nil if disabled;
+// closing: closed once Server.Shutdown begins, nil if never shut down;
+// handlers: handler goroutines in flight; conns: TCP connections from clients being served
+type relay struct {
+	cfg      *Config
+	hosts    *hostsTable
+	blocks   *blockStore
+	allow    *hostsStore
+	cache    *answerCache
+	pool     *upstreamPool
+	queryLog *queryLog
+
+	closing  chan struct{}
+	handlers sync.WaitGroup
+	connsMtx sync.Mutex
+	conns    map[net.Conn]struct{}
+}
 
-	// local DNS run over UDP port 53
-	port := ":53"
-	clientsConn, err := net.ListenPacket("udp", port)
-	checkError("udp clients success", err, true)
+// isClosing is a function to check whether shutdown has begun, so no more queries should be read
+func (r *relay) isClosing() bool {
+	select {
+	case <-r.closing:
+		return true
+	default:
+		return false
+	}
+}
 
-	// local DNS communicate with remote DNS
-	remoteDNSAddr := "192.168.10.1:53"
-	udpRemoteDNSAddr, _ := net.ResolveUDPAddr("udp", remoteDNSAddr)
-	connToRemote, err := net.DialUDP("udp", nil, udpRemoteDNSAddr)
-	checkError("success to create a dial towards remote", err, true)
+// goHandler is a function to run handler in a goroutine counted by r.handlers, done is called once it returns
+func (r *relay) goHandler(sbuf *safeBuf, w respWriter, done func()) {
+	r.handlers.Add(1)
+	go func() {
+		defer r.handlers.Done()
+		defer done()
+		defer recoverPanic("handler", "client", w.remoteAddr().String(), "proto", w.network())
+		handler(r, sbuf, w)
+	}()
+}
 
+// recoverPanic is a function deferred by goroutines serving clients, so a panic fails only what it was serving
+// instead of the whole process; the panic is logged with its stack and attrs, and counted
+func recoverPanic(goroutine string, attrs ...any) {
+	if v := recover(); v != nil {
+		relayMetrics.panics.Add(1)
+		attrs = append(attrs, "goroutine", goroutine, "panic", v, "stack", string(debug.Stack()))
+		slog.Error("panic recovered", attrs...)
+	}
+}
+
+// DNSRelay is the main function, serving until SIGINT or SIGTERM, then shutting down within cfg.ShutdownTimeout
+func DNSRelay(cfg *Config, hosts *hostsTable, blocks *blockStore) error {
+	srv := NewServer(cfg, hosts, blocks)
+	if err := srv.Start(); err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	<-ctx.Done()
+	stop()
+	slog.Info("shutting down", "timeout", cfg.ShutdownTimeout.Duration)
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout.Duration)
+	defer cancel()
+	return srv.Shutdown(ctx)
+}
+
+// serve is a function to read queries from clientsConn and handle each in a goroutine, until shutdown
+func (r *relay) serve(clientsConn net.PacketConn) {
 	for {
 		sbuf := new(safeBuf)
-		sbuf.buf = make([]byte, 512)
+		sbuf.buf = make([]byte, maxUDPSize)
 
 		sbuf.mtx.Lock()
-		_, addr, err := clientsConn.ReadFrom(sbuf.buf)
+		n, addr, err := clientsConn.ReadFrom(sbuf.buf)
+		sbuf.buf = sbuf.buf[:n]
 		sbuf.mtx.Unlock()
 
-		checkError("udp read success", err, true)
-		fmt.Println("DNS-Relay> clients remote addr:", addr, addr.String())
+		if r.isClosing() || errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			// such as ICMP port unreachable of a former response, the socket is still usable
+			slog.Warn("read from udp clients failed", "err", err)
+			relayMetrics.socketError("read")
+			continue
+		}
+		slog.Debug("udp query", "client", addr.String())
 
 		// use sbuf instead of sbuf.buf to protect data in sbuf.buf
-		go handler(hosts, sbuf, connToRemote, clientsConn, addr)
+		r.goHandler(sbuf, udpWriter{clientsConn: clientsConn, addr: addr, limit: minUDPSize}, func() {})
 	}
 }
 
-// hosts: an IP address;
+// r: a relay that includes config, hosts, cache and pool;
 // sbuf: a struct that includes mutex and buf;
-// connToRemote: from net.DialUDP, a connect to remote server
-// clientsConn: from net.ListenPacket, 127.0.0.1:53
-// addr: from clientsConn.ReadFrom, address which is on the packet received
-func handler(hosts map[string]string, sbuf *safeBuf, connToRemote *net.UDPConn, clientsConn net.PacketConn, addr net.Addr) {
+// w: a respWriter sending response to the client over UDP or TCP
+func handler(r *relay, sbuf *safeBuf, w respWriter) {
+	start := time.Now()
+	relayMetrics.inFlight.Add(1)
+	defer relayMetrics.inFlight.Add(-1)
+	log := slog.With("client", w.remoteAddr().String(), "proto", w.network())
+	// send is a closure to write resp, a failure only loses this response, so it's logged and counted
+	send := func(resp []byte) {
+		if err := w.write(resp); err != nil {
+			log.Warn("write response failed", "err", err)
+			relayMetrics.socketError("write")
+		}
+	}
 	sbuf.mtx.Lock()
-	dnsMsgHdr, dnsMsgQst, _ := parseDNSRequest(sbuf.buf)
+	if hdr, err := parseDNSHdr(sbuf.buf); err == nil {
+		flags := hdr.parseFlags()
+		// never answer a response, or two relays might bounce answers to each other
+		if flags.QR == 1 {
+			log.Debug("drop response")
+			relayMetrics.drop(dropResponse)
+			sbuf.mtx.Unlock()
+			return
+		}
+		// only standard queries are answered, neither hosts nor remote DNS serve UPDATE, NOTIFY...
+		if flags.Opcode != 0 {
+			log.Debug("opcode not implemented", "opcode", flags.Opcode)
+			w.write(composeNotImp(hdr))
+			sbuf.mtx.Unlock()
+			return
+		}
+	}
+	req, err := unpackDNSMsg(sbuf.buf)
+	if err == nil && len(req.Qst) != 1 {
+		err = errNoQuestion
+	}
+	var opt *DNSMsgOPT
+	if err == nil {
+		opt, err = findOPT(req)
+	}
+	if err != nil {
+		log.Debug("malformed query", "err", err)
+		relayMetrics.parseError("client")
+		// never answer a malformed response, or two relays might bounce FORMERR to each other
+		if hdr, hdrErr := parseDNSHdr(sbuf.buf); hdrErr == nil && hdr.parseFlags().QR == 0 {
+			send(composeFormErr(hdr))
+		} else {
+			relayMetrics.drop(dropMalformedQuery)
+		}
+		sbuf.mtx.Unlock()
+		return
+	}
 	sbuf.mtx.Unlock()
+	dnsMsgHdr, dnsMsgQst := req.Hdr, req.Qst[0]
 
+	// a client with EDNS(0) gets OPT in every response, and UDP responses up to the negotiated size
+	udpSize := r.cfg.EDNSUDPSize
+	if uw, ok := w.(udpWriter); ok {
+		uw.limit = udpLimit(opt, udpSize)
+		w = uw
+	}
 	targetDomainName := dnsMsgQst.parseDomainName()
-	targetIP, _ := getIPAddrByDomainName(hosts, targetDomainName)
-
-	fmt.Printf("DNS-Relay> target IP wuhu: %s, target Domain Name: %s\n", targetIP, targetDomainName)
-	if len(targetIP) == 0 {
-		fmt.Println("DNS-Relay> communicate with remote DNS...")
-		resp := communicateWithForwardDNS(connToRemote, dnsMsgHdr, dnsMsgQst)
-		hdr, qst, length := parseDNSRequest(resp)
-		hdr.ID--
-		resp = composeHdrQstMultiRR(hdr, qst, resp[length:])
-		_, err := clientsConn.WriteTo(resp, addr)
-		checkError("return udp success", err, true)
-		fmt.Println("DNS-Relay>", resp)
-	} else if targetIP == "127.0.0.1" || targetIP == "0.0.0.0" {
-		// 127.0.0.1 and 0.0.0.0 is 2 types of forbidden ip in DNS hosts
-		// RCODE(3) in "0x8183" means name error
-		hdr := DNSMsgHdr{
-			dnsMsgHdr.ID, 0x8183,
-			dnsMsgHdr.QDCOUNT, dnsMsgHdr.ANCOUNT,
-			dnsMsgHdr.NSCOUNT, dnsMsgHdr.ARCOUNT,
+	log = log.With("qname", targetDomainName, "qtype", qtypeName(dnsMsgQst.QTYPE))
+	// reply is a closure to send resp and log how the query is answered
+	reply := func(resp []byte, decision, upstream string, attrs ...any) {
+		latency := time.Since(start)
+		rcode := respRcode(resp)
+		// attrs are only built when the record is going to be written
+		if log.Enabled(context.Background(), slog.LevelDebug) {
+			attrs = append(attrs, "decision", decision, "rcode", rcodeName(rcode), "latency", latency)
+			if upstream != "" {
+				attrs = append(attrs, "upstream", upstream)
+			}
+			log.Debug("query answered", attrs...)
+		}
+		relayMetrics.query(qtypeName(dnsMsgQst.QTYPE), rcodeName(rcode), decision)
+		r.queryLog.record(queryLogEntry{
+			Time: start, Client: w.remoteAddr().String(), Proto: w.network(),
+			QName: targetDomainName, QType: qtypeName(dnsMsgQst.QTYPE),
+			Decision: decision, Upstream: upstream, Latency: float64(latency) / float64(time.Millisecond),
+			resp: resp,
+		})
+		send(replyOPT(resp, opt, udpSize))
+	}
+	if opt != nil && opt.Version != 0 {
+		reply(composeBadVers(dnsMsgHdr, dnsMsgQst, udpSize), decisionRejected, "", "version", opt.Version)
+		return
+	}
+
+	// neither hosts nor cache nor remote DNS is asked for CHAOS, HESIOD..., RCODE(5) means refused
+	if !isLocalClass(dnsMsgQst.QCLASS) {
+		reply(composeRcode(dnsMsgHdr, dnsMsgQst, 5), decisionRejected, "", "qclass", dnsMsgQst.QCLASS)
+		return
+	}
+
+	match, source, found, allowed := r.lookupLocal(targetDomainName)
+	if allowed != "" {
+		log = log.With("allowed_by", allowed)
+	}
+	if !found {
+		if resp, negative, ok := r.cache.get(dnsMsgHdr, dnsMsgQst, opt); ok {
+			relayMetrics.cacheHits.Add(1)
+			reply(resp, decisionCached, "", "cache_hit", true, "negative", negative)
+			return
 		}
-		resp := composeHdrQst(hdr, dnsMsgQst)
-		fmt.Println("DNS-Relay>", resp)
-		clientsConn.WriteTo(resp, addr)
+		relayMetrics.cacheMisses.Add(1)
+		resp, upstream, err := communicateWithForwardDNS(r.pool, dnsMsgHdr, dnsMsgQst, forwardOPT(opt, udpSize), r.cfg.retryPolicy())
+		if err != nil {
+			// RCODE(2) means server failure
+			resp = composeRcode(dnsMsgHdr, dnsMsgQst, 2)
+			reply(resp, decisionForwarded, "", "cache_hit", false, "err", err)
+			return
+		}
+		r.cache.put(dnsMsgHdr, dnsMsgQst, opt, resp)
+		reply(resp, decisionForwarded, upstream, "cache_hit", false)
+	} else if mode, blocked := blockModeOf(match.records, r.cfg.BlockMode); blocked {
+		resp := composeBlock(dnsMsgHdr, dnsMsgQst, mode, r.cfg.Sinkhole, r.cfg.LocalTTL)
+		reply(resp, decisionBlocked, "", "source", source, "rule", match.rule, "mode", mode)
 	} else {
 		// found in hosts
-		fmt.Println("DNS-Relay> found in hosts:", targetIP, "<=>", targetDomainName)
-		hdr := DNSMsgHdr{
-			dnsMsgHdr.ID, 0x8180,
-			dnsMsgHdr.QDCOUNT, dnsMsgHdr.ANCOUNT,
-			dnsMsgHdr.NSCOUNT, dnsMsgHdr.ARCOUNT,
+		var targetIPs []string
+		for _, record := range match.records {
+			targetIPs = append(targetIPs, record.ip)
 		}
-		asr := createDNSMsgAsr(1, 1, 31, 4, targetIP)
-		resp := composeHdrQstAsr(hdr, dnsMsgQst, asr)
-		fmt.Println("DNS-Relay>", resp)
-		clientsConn.WriteTo(resp, addr)
+		resp := composeAddrs(dnsMsgHdr, dnsMsgQst, targetIPs, r.cfg.LocalTTL)
+		reply(resp, decisionHosts, "", "source", source, "rule", match.rule, "ips", targetIPs)
 	}
 }
 
 func main() {
-	hosts := initDNSHosts()
-	DNSRelay(hosts)
+	cfg, err := loadConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "DNS-Relay> %s\n", err.Error())
+		os.Exit(2)
+	}
+	slog.SetDefault(newLogger(os.Stderr, cfg.LogFormat, cfg.logLevel()))
+	dnsHosts, warnings, err := loadDNSHosts(cfg.Hosts)
+	for _, warning := range warnings {
+		msg, attrs := lineWarning(warning)
+		slog.Warn(msg, attrs...)
+	}
+	if err != nil {
+		slog.Error("read hosts file failed", "err", err)
+		os.Exit(1)
+	}
+	blocks, err := initBlocklists(cfg.Blocklists)
+	if err != nil {
+		slog.Error("read blocklist failed", "err", err)
+		os.Exit(1)
+	}
+	if err = DNSRelay(cfg, newHostsTable(cfg.Hosts, dnsHosts), blocks); err != nil {
+		slog.Error("DNS Relay failed", "err", err)
+		os.Exit(1)
+	}
 }
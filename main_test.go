@@ -1,9 +1,11 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"net"
 	"os"
+	"reflect"
 	"testing"
 )
 
@@ -43,7 +45,7 @@ func TestParseDNSMsgHdr(t *testing.T) {
 		0x00, 0x00,
 	}
 
-	dnsMsgHdr := parseDNSHdr(testData)
+	dnsMsgHdr, _ := parseDNSHdr(testData)
 	flags := dnsMsgHdr.parseFlags()
 	fmt.Println(dnsMsgHdr, flags)
 }
@@ -54,7 +56,7 @@ func TestParseDNSQst(t *testing.T) {
 		0x06, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x03, 0x63, 0x6f, 0x6d, 0x00,
 		0x00, 0x01, 0x00, 0x01,
 	}
-	dnsMsgQst, _ := parseDNSQst(testData)
+	dnsMsgQst, _, _ := parseDNSQst(testData)
 	fmt.Println(dnsMsgQst, dnsMsgQst.QNAME, dnsMsgQst.QTYPE, dnsMsgQst.QCLASS)
 }
 
@@ -70,7 +72,7 @@ func TestParseDNSRequest(t *testing.T) {
 		0x06, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x03, 0x63, 0x6f, 0x6d, 0x00,
 		0x00, 0x00, 0x00, 0x01,
 	}
-	dnsMsgHdr, dnsMsgQst, _ := parseDNSRequest(testData)
+	dnsMsgHdr, dnsMsgQst, _, _ := parseDNSRequest(testData)
 	fmt.Println(dnsMsgHdr.ID, dnsMsgHdr.parseFlags(), dnsMsgHdr.QDCOUNT, dnsMsgHdr.ANCOUNT, dnsMsgHdr.NSCOUNT, dnsMsgHdr.ARCOUNT)
 	fmt.Println(dnsMsgQst.QNAME, dnsMsgQst.QTYPE, dnsMsgQst.QCLASS)
 }
@@ -87,7 +89,7 @@ func TestComposeHdrQstAsr(t *testing.T) {
 		0x06, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x03, 0x63, 0x6f, 0x6d, 0x00,
 		0x00, 0x00, 0x00, 0x01,
 	}
-	dnsMsgHdr, dnsMsgQst, _ := parseDNSRequest(testData)
+	dnsMsgHdr, dnsMsgQst, _, _ := parseDNSRequest(testData)
 	dnsMsgAsr := DNSMsgRR{
 		NAME:     []byte{0xc0, 0x0c},
 		TYPE:     1,
@@ -107,7 +109,7 @@ func TestCreateDNSMsgAsr(t *testing.T) {
 
 func TestGetIPAddrByDomainName(t *testing.T) {
 	fmt.Println("TestgetIPAddrByDomainName:")
-	hosts := initDNSHosts()
+	hosts := initDNSHosts([]string{"hosts"})
 	var testData []string = []string{
 		"www.baidu.com", "www.bilibili.com", "www.ljg.top",
 	}
@@ -119,9 +121,11 @@ func TestGetIPAddrByDomainName(t *testing.T) {
 
 func TestInitDNSHosts(t *testing.T) {
 	fmt.Println("TestInitDNSHosts:")
-	dnsHosts := initDNSHosts()
-	for k, v := range dnsHosts {
-		fmt.Printf("key(%s): value(%s)\n", k, v)
+	dnsHosts := initDNSHosts([]string{"hosts"})
+	for name, records := range dnsHosts.names {
+		for _, v := range records {
+			fmt.Printf("key(%s): value(%s)\n", v.ip, name)
+		}
 	}
 }
 
@@ -158,3 +162,83 @@ func TestGoSocket(t *testing.T) {
 		fmt.Println(string(buf), buf)
 	}
 }
+
+func TestComposeAddrs(t *testing.T) {
+	r := testRelay("10.0.0.1 www.ljg.top\n2001:db8::1 www.ljg.top\n2001:db8::2 v6.ljg.top\n::ffff:10.1.2.3 mapped.ljg.top\n")
+	cases := []struct {
+		name  string
+		qtype uint16
+		want  []byte
+	}{
+		{"www.ljg.top", 1, []byte{10, 0, 0, 1}},
+		{"www.ljg.top", 28, net.ParseIP("2001:db8::1").To16()},
+		{"v6.ljg.top", 28, net.ParseIP("2001:db8::2").To16()},
+		{"v6.ljg.top", 1, nil},
+		// an IPv4-mapped address is IPv4
+		{"mapped.ljg.top", 1, []byte{10, 1, 2, 3}},
+		{"mapped.ljg.top", 28, nil},
+	}
+	for _, c := range cases {
+		query := composeHdrQst(DNSMsgHdr{ID: 1, FLAGS: 0x0100, QDCOUNT: 1},
+			DNSMsgQst{QNAME: testQNAME(c.name), QTYPE: c.qtype, QCLASS: 1})
+		m := testExchange(t, r, query)
+		if rcode := m.Hdr.parseFlags().RCODE; rcode != 0 {
+			t.Errorf("%s type %d: RCODE %d, want 0", c.name, c.qtype, rcode)
+			continue
+		}
+		if c.want == nil {
+			if len(m.Asr) != 0 {
+				t.Errorf("%s type %d should be NODATA, got %+v", c.name, c.qtype, m.Asr)
+			}
+			continue
+		}
+		if len(m.Asr) != 1 || m.Asr[0].TYPE != c.qtype || !bytes.Equal(m.Asr[0].RDATA, c.want) {
+			t.Errorf("%s type %d: got %+v, want RDATA %v", c.name, c.qtype, m.Asr, c.want)
+		}
+	}
+}
+
+func TestLocalQTYPE(t *testing.T) {
+	r := testRelay("10.0.0.1 www.ljg.top\n2001:db8::1 www.ljg.top\n0.0.0.0 www.bilibili.com\n")
+	cases := []struct {
+		name   string
+		qtype  uint16
+		rcode  uint8
+		answer []uint16
+	}{
+		{"www.ljg.top", 255, 0, []uint16{1, 28}},
+		{"www.ljg.top", 15, 0, nil},
+		{"www.ljg.top", 16, 0, nil},
+		{"www.ljg.top", 65, 0, nil},
+		{"www.bilibili.com", 15, 3, nil},
+	}
+	for _, c := range cases {
+		query := composeHdrQst(DNSMsgHdr{ID: 1, FLAGS: 0x0100, QDCOUNT: 1},
+			DNSMsgQst{QNAME: testQNAME(c.name), QTYPE: c.qtype, QCLASS: 1})
+		m := testExchange(t, r, query)
+		flags := m.Hdr.parseFlags()
+		if flags.RCODE != c.rcode || flags.RD != 1 || m.Hdr.QDCOUNT != 1 || m.Hdr.NSCOUNT != 0 || m.Hdr.ARCOUNT != 0 {
+			t.Errorf("%s type %d: unexpected header %+v", c.name, c.qtype, m.Hdr)
+		}
+		var types []uint16
+		for _, rr := range m.Asr {
+			types = append(types, rr.TYPE)
+		}
+		if int(m.Hdr.ANCOUNT) != len(c.answer) || !reflect.DeepEqual(types, c.answer) {
+			t.Errorf("%s type %d: answer types %v, want %v", c.name, c.qtype, types, c.answer)
+		}
+	}
+}
+
+func TestRefuseQCLASS(t *testing.T) {
+	r := testRelay("10.0.0.1 www.ljg.top\n")
+	// CH(3) and HS(4) are never forwarded, and hosts holds nothing for them
+	for _, qclass := range []uint16{3, 4, 254} {
+		query := composeHdrQst(DNSMsgHdr{ID: 1, FLAGS: 0x0100, QDCOUNT: 1},
+			DNSMsgQst{QNAME: testQNAME("www.ljg.top"), QTYPE: 16, QCLASS: qclass})
+		m := testExchange(t, r, query)
+		if flags := m.Hdr.parseFlags(); flags.RCODE != 5 || m.Hdr.ANCOUNT != 0 || m.Qst[0].QCLASS != qclass {
+			t.Errorf("class %d: unexpected response %+v", qclass, m.Hdr)
+		}
+	}
+}
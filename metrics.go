@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets are upper bounds (second) of upstream latency histograms
+var latencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+// reasons of dropped packets, label of dns_relay_dropped_packets_total
+// malformed_query: a message from a client too short to hold a header, so it's not answered with FORMERR;
+// response: a message from a client which is a response, never answered whether malformed or not;
+// malformed_reply: a malformed reply from remote DNS; unexpected_reply: a reply matching no outstanding query
+const (
+	dropMalformedQuery  = "malformed_query"
+	dropResponse        = "response"
+	dropMalformedReply  = "malformed_reply"
+	dropUnexpectedReply = "unexpected_reply"
+)
+
+// queryKey is the labels of dns_relay_queries_total
+type queryKey struct {
+	qtype    string
+	rcode    string
+	decision string
+}
+
+// histogram is a Prometheus histogram of latencies (second), counts[i] counts observations within latencyBuckets[i]
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// observe is a function to add a latency to h
+func (h *histogram) observe(d time.Duration) {
+	v := d.Seconds()
+	for i, bound := range latencyBuckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// metrics is counters of DNS Relay exposed in Prometheus text format, see writeTo
+// counters labeled by names are kept in maps under mtx, the others are atomic
+type metrics struct {
+	mtx             sync.Mutex
+	queries         map[queryKey]uint64
+	parseErrors     map[string]uint64
+	dropped         map[string]uint64
+	upstreamLatency map[string]*histogram
+	upstreamErrors  map[string]uint64
+	socketErrors    map[string]uint64
+
+	cacheHits   atomic.Uint64
+	cacheMisses atomic.Uint64
+	retries     atomic.Uint64
+	inFlight    atomic.Int64
+	panics      atomic.Uint64
+}
+
+// newMetrics is a function to create metrics with every counter zero
+func newMetrics() *metrics {
+	return &metrics{
+		queries:         make(map[queryKey]uint64),
+		parseErrors:     make(map[string]uint64),
+		dropped:         make(map[string]uint64),
+		upstreamLatency: make(map[string]*histogram),
+		upstreamErrors:  make(map[string]uint64),
+		socketErrors:    make(map[string]uint64),
+	}
+}
+
+// relayMetrics is metrics of this process, served by metricsHandler
+var relayMetrics = newMetrics()
+
+// query is a function to count a query answered
+func (m *metrics) query(qtype, rcode, decision string) {
+	m.mtx.Lock()
+	m.queries[queryKey{qtype, rcode, decision}]++
+	m.mtx.Unlock()
+}
+
+// parseError is a function to count a malformed message, source is "client" or "upstream"
+func (m *metrics) parseError(source string) {
+	m.mtx.Lock()
+	m.parseErrors[source]++
+	m.mtx.Unlock()
+}
+
+// drop is a function to count a packet dropped for reason
+func (m *metrics) drop(reason string) {
+	m.mtx.Lock()
+	m.dropped[reason]++
+	m.mtx.Unlock()
+}
+
+// socketError is a function to count a failed operation on a socket of clients, op is "read", "write" or "accept"
+func (m *metrics) socketError(op string) {
+	m.mtx.Lock()
+	m.socketErrors[op]++
+	m.mtx.Unlock()
+}
+
+// upstream is a function to count an exchange with remote DNS at addr,
+// latency of a successful one is observed, a failed one is counted as error
+func (m *metrics) upstream(addr string, latency time.Duration, err error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if err != nil {
+		m.upstreamErrors[addr]++
+		return
+	}
+	h, ok := m.upstreamLatency[addr]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		m.upstreamLatency[addr] = h
+	}
+	h.observe(latency)
+}
+
+// writeTo is a function to write every metric in Prometheus text exposition format, version 0.0.4
+func (m *metrics) writeTo(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	header := func(name, typ, help string) {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+
+	m.mtx.Lock()
+	header("dns_relay_queries_total", "counter", "Queries answered, by QTYPE, RCODE and how they are answered.")
+	keys := make([]queryKey, 0, len(m.queries))
+	for key := range m.queries {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.qtype != b.qtype {
+			return a.qtype < b.qtype
+		}
+		if a.rcode != b.rcode {
+			return a.rcode < b.rcode
+		}
+		return a.decision < b.decision
+	})
+	for _, key := range keys {
+		fmt.Fprintf(bw, "dns_relay_queries_total{qtype=%s,rcode=%s,decision=%s} %d\n",
+			quoteLabel(key.qtype), quoteLabel(key.rcode), quoteLabel(key.decision), m.queries[key])
+	}
+
+	header("dns_relay_parse_errors_total", "counter", "Malformed DNS messages, by where they come from.")
+	writeLabeled(bw, "dns_relay_parse_errors_total", "source", m.parseErrors)
+	header("dns_relay_dropped_packets_total", "counter", "Packets dropped without answer, by reason.")
+	writeLabeled(bw, "dns_relay_dropped_packets_total", "reason", m.dropped)
+	header("dns_relay_upstream_errors_total", "counter", "Failed exchanges with remote DNS, by upstream.")
+	writeLabeled(bw, "dns_relay_upstream_errors_total", "upstream", m.upstreamErrors)
+	header("dns_relay_socket_errors_total", "counter", "Failed operations on sockets of clients, by operation.")
+	writeLabeled(bw, "dns_relay_socket_errors_total", "op", m.socketErrors)
+
+	header("dns_relay_upstream_latency_seconds", "histogram", "Latency of answered exchanges with remote DNS, by upstream.")
+	addrs := make([]string, 0, len(m.upstreamLatency))
+	for addr := range m.upstreamLatency {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	for _, addr := range addrs {
+		h, label := m.upstreamLatency[addr], quoteLabel(addr)
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(bw, "dns_relay_upstream_latency_seconds_bucket{upstream=%s,le=\"%g\"} %d\n", label, bound, h.counts[i])
+		}
+		fmt.Fprintf(bw, "dns_relay_upstream_latency_seconds_bucket{upstream=%s,le=\"+Inf\"} %d\n", label, h.count)
+		fmt.Fprintf(bw, "dns_relay_upstream_latency_seconds_sum{upstream=%s} %g\n", label, h.sum)
+		fmt.Fprintf(bw, "dns_relay_upstream_latency_seconds_count{upstream=%s} %d\n", label, h.count)
+	}
+	m.mtx.Unlock()
+
+	header("dns_relay_cache_hits_total", "counter", "Queries answered from cache.")
+	fmt.Fprintf(bw, "dns_relay_cache_hits_total %d\n", m.cacheHits.Load())
+	header("dns_relay_cache_misses_total", "counter", "Queries forwarded to remote DNS since cache has no answer.")
+	fmt.Fprintf(bw, "dns_relay_cache_misses_total %d\n", m.cacheMisses.Load())
+	header("dns_relay_upstream_retries_total", "counter", "Queries retried after remote DNS failed.")
+	fmt.Fprintf(bw, "dns_relay_upstream_retries_total %d\n", m.retries.Load())
+	header("dns_relay_in_flight_queries", "gauge", "Queries being handled.")
+	fmt.Fprintf(bw, "dns_relay_in_flight_queries %d\n", m.inFlight.Load())
+	header("dns_relay_panics_total", "counter", "Panics recovered while serving clients.")
+	fmt.Fprintf(bw, "dns_relay_panics_total %d\n", m.panics.Load())
+	header("dns_relay_goroutines", "gauge", "Goroutines of the process.")
+	fmt.Fprintf(bw, "dns_relay_goroutines %d\n", runtime.NumGoroutine())
+	return bw.Flush()
+}
+
+// writeLabeled is a function to write samples of a counter with a single label, sorted by label value
+func writeLabeled(w io.Writer, name, label string, counts map[string]uint64) {
+	values := make([]string, 0, len(counts))
+	for value := range counts {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	for _, value := range values {
+		fmt.Fprintf(w, "%s{%s=%s} %d\n", name, label, quoteLabel(value), counts[value])
+	}
+}
+
+// labelEscaper escapes label values as Prometheus text format requires
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// quoteLabel is a function to quote a label value
+func quoteLabel(value string) string {
+	return `"` + labelEscaper.Replace(value) + `"`
+}
+
+// metricsHandler is a function to serve m at /metrics
+func metricsHandler(m *metrics) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		m.writeTo(w)
+	})
+	return mux
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsWriteTo(t *testing.T) {
+	m := newMetrics()
+	m.query("A", "NOERROR", decisionHosts)
+	m.query("A", "NOERROR", decisionHosts)
+	m.query("AAAA", "NXDOMAIN", decisionBlocked)
+	m.parseError("client")
+	m.drop(dropUnexpectedReply)
+	m.upstream("8.8.8.8:53", 3*time.Millisecond, nil)
+	m.upstream("8.8.8.8:53", 2*time.Second, nil)
+	m.upstream("1.1.1.1:53", time.Second, errors.New("timeout"))
+	m.socketError("write")
+	m.cacheHits.Add(1)
+	m.inFlight.Add(2)
+	m.panics.Add(1)
+
+	var sb strings.Builder
+	if err := m.writeTo(&sb); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"# TYPE dns_relay_queries_total counter",
+		`dns_relay_queries_total{qtype="A",rcode="NOERROR",decision="hosts"} 2`,
+		`dns_relay_queries_total{qtype="AAAA",rcode="NXDOMAIN",decision="blocked"} 1`,
+		`dns_relay_parse_errors_total{source="client"} 1`,
+		`dns_relay_dropped_packets_total{reason="unexpected_reply"} 1`,
+		`dns_relay_upstream_errors_total{upstream="1.1.1.1:53"} 1`,
+		"# TYPE dns_relay_upstream_latency_seconds histogram",
+		`dns_relay_upstream_latency_seconds_bucket{upstream="8.8.8.8:53",le="0.0025"} 0`,
+		`dns_relay_upstream_latency_seconds_bucket{upstream="8.8.8.8:53",le="0.005"} 1`,
+		`dns_relay_upstream_latency_seconds_bucket{upstream="8.8.8.8:53",le="2.5"} 2`,
+		`dns_relay_upstream_latency_seconds_bucket{upstream="8.8.8.8:53",le="+Inf"} 2`,
+		`dns_relay_upstream_latency_seconds_count{upstream="8.8.8.8:53"} 2`,
+		"dns_relay_cache_hits_total 1",
+		"dns_relay_cache_misses_total 0",
+		"dns_relay_in_flight_queries 2",
+		`dns_relay_socket_errors_total{op="write"} 1`,
+		"dns_relay_panics_total 1",
+	} {
+		if !strings.Contains(sb.String(), line+"\n") {
+			t.Errorf("no line %s in\n%s", line, sb.String())
+		}
+	}
+	if quoteLabel("a\"b\\c\n") != `"a\"b\\c\n"` {
+		t.Errorf("label is quoted as %s", quoteLabel("a\"b\\c\n"))
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	r := testRelay("0.0.0.0 ads.ljg.top\n")
+	r.pool = newUpstreamPool(nil, strategyFailover, 1)
+	r.cfg.Retries = 0
+	misses := relayMetrics.cacheMisses.Load()
+	testExchange(t, r, testQuery(1, "ads.ljg.top"))
+	testExchange(t, r, testQuery(2, "www.ljg.top"))
+	if relayMetrics.cacheMisses.Load() != misses+1 {
+		t.Errorf("cache misses %d, want %d", relayMetrics.cacheMisses.Load(), misses+1)
+	}
+
+	server := httptest.NewServer(metricsHandler(relayMetrics))
+	defer server.Close()
+	resp, err := server.Client().Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("content type is %s", resp.Header.Get("Content-Type"))
+	}
+	for _, sample := range []string{
+		`dns_relay_queries_total{qtype="A",rcode="NXDOMAIN",decision="blocked"} `,
+		`dns_relay_queries_total{qtype="A",rcode="SERVFAIL",decision="forwarded"} `,
+		"# TYPE dns_relay_in_flight_queries gauge",
+	} {
+		if !strings.Contains(string(body), sample) {
+			t.Errorf("no sample %s in\n%s", sample, body)
+		}
+	}
+}
+
+// recordWriter is a respWriter keeping every response written by handler
+type recordWriter struct {
+	resps *[][]byte
+}
+
+func (w recordWriter) write(resp []byte) error {
+	*w.resps = append(*w.resps, resp)
+	return nil
+}
+
+func (w recordWriter) remoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+
+func (w recordWriter) network() string { return "udp" }
+
+func TestHandlerNonQuery(t *testing.T) {
+	r := testRelay("10.0.0.1 www.ljg.top\n")
+	var resps [][]byte
+	w := recordWriter{resps: &resps}
+
+	// a response is dropped before looking the name up, and counted
+	relayMetrics.mtx.Lock()
+	dropped := relayMetrics.dropped[dropResponse]
+	relayMetrics.mtx.Unlock()
+	response := testQuery(1, "www.ljg.top")
+	response[2] |= 0x80
+	handler(r, &safeBuf{buf: response}, w)
+	relayMetrics.mtx.Lock()
+	if relayMetrics.dropped[dropResponse] != dropped+1 {
+		t.Errorf("dropped responses %d, want %d", relayMetrics.dropped[dropResponse], dropped+1)
+	}
+	relayMetrics.mtx.Unlock()
+	if len(resps) != 0 {
+		t.Fatalf("a response is answered with %v", resps)
+	}
+
+	// UPDATE(5) gets NOTIMP, without looking the name up
+	update := testQuery(2, "www.ljg.top")
+	update[2] |= 5 << 3
+	handler(r, &safeBuf{buf: update}, w)
+	if len(resps) != 1 {
+		t.Fatalf("UPDATE is answered %d times", len(resps))
+	}
+	hdr, err := parseDNSHdr(resps[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flags := hdr.parseFlags(); hdr.ID != 2 || flags.QR != 1 || flags.Opcode != 5 || flags.RCODE != 4 || hdr.ANCOUNT != 0 {
+		t.Errorf("unexpected response to UPDATE: %+v", hdr)
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// strategies of picking an upstream from upstreamPool
+// failover: the first healthy upstream in configured order
+// round-robin: healthy upstreams in turn
+// random: a random healthy upstream
+// fastest: the healthy upstream with the lowest average latency
+const (
+	strategyFailover   = "failover"
+	strategyRoundRobin = "round-robin"
+	strategyRandom     = "random"
+	strategyFastest    = "fastest"
+)
+
+// errNoHealthyUpstream is returned when every upstream is ejected from upstreamPool
+var errNoHealthyUpstream = errors.New("no healthy remote DNS")
+
+// upstream is a remote DNS in upstreamPool
+// failures: consecutive failed queries and probes, reset by any success
+// latency: exponentially weighted moving average of round-trip time
+type upstream struct {
+	addr     string
+	mux      *upstreamMux
+	mtx      sync.Mutex
+	healthy  bool
+	failures int
+	latency  time.Duration
+}
+
+// newUpstream is a function to create a healthy upstream over mux
+func newUpstream(addr string, mux *upstreamMux) *upstream {
+	return &upstream{addr: addr, mux: mux, healthy: true}
+}
+
+// dialUpstream is a function to create a connection towards remote DNS at addr
+func dialUpstream(addr string) (*upstream, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp", nil, udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	return newUpstream(addr, newUpstreamMux(conn)), nil
+}
+
+// isHealthy is a function to check whether u can be picked
+func (u *upstream) isHealthy() bool {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	return u.healthy
+}
+
+// avgLatency is a function to get the average round-trip time of u
+func (u *upstream) avgLatency() time.Duration {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	return u.latency
+}
+
+// report is a function to record the result of a query or probe sent to u
+// u is ejected after maxFails consecutive failures, and admitted again by any success
+func (u *upstream) report(rtt time.Duration, err error, maxFails int) {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	if err != nil {
+		u.failures++
+		if u.healthy && u.failures >= maxFails {
+			u.healthy = false
+			slog.Warn("remote DNS ejected", "upstream", u.addr, "failures", u.failures, "err", err)
+		}
+		return
+	}
+	if !u.healthy {
+		slog.Info("remote DNS admitted again", "upstream", u.addr)
+	}
+	u.healthy = true
+	u.failures = 0
+	if u.latency == 0 {
+		u.latency = rtt
+	} else {
+		u.latency = (u.latency*7 + rtt*3) / 10
+	}
+}
+
+// upstreamPool is a set of remote DNS, queries are sent to one of the healthy ones
+type upstreamPool struct {
+	upstreams []*upstream
+	strategy  string
+	protocol  string
+	maxFails  int
+	next      uint32
+	stop      chan struct{}
+	stopOnce  sync.Once
+}
+
+// newUpstreamPool is a function to create upstreamPool picking upstreams by strategy
+// queries are sent over UDP (falling back to TCP once truncated), see exchange
+func newUpstreamPool(upstreams []*upstream, strategy string, maxFails int) *upstreamPool {
+	return &upstreamPool{
+		upstreams: upstreams,
+		strategy:  strategy,
+		protocol:  "udp",
+		maxFails:  maxFails,
+		stop:      make(chan struct{}),
+	}
+}
+
+// dialUpstreamPool is a function to create upstreamPool over cfg.Upstreams
+func dialUpstreamPool(cfg *Config) (*upstreamPool, error) {
+	var upstreams []*upstream
+	for _, addr := range cfg.Upstreams {
+		u, err := dialUpstream(addr)
+		if err != nil {
+			for _, u := range upstreams {
+				u.mux.close()
+			}
+			return nil, fmt.Errorf("dial remote DNS %s: %w", addr, err)
+		}
+		upstreams = append(upstreams, u)
+	}
+	pool := newUpstreamPool(upstreams, cfg.UpstreamStrategy, cfg.MaxFails)
+	pool.protocol = cfg.UpstreamProtocol
+	return pool, nil
+}
+
+// healthy is a function to list healthy upstreams in configured order
+func (p *upstreamPool) healthy() (upstreams []*upstream) {
+	for _, u := range p.upstreams {
+		if u.isHealthy() {
+			upstreams = append(upstreams, u)
+		}
+	}
+	return
+}
+
+// pick is a function to choose a healthy upstream by p.strategy
+// upstreams in exclude are avoided unless they are the only healthy ones
+func (p *upstreamPool) pick(exclude ...*upstream) (*upstream, error) {
+	healthy := p.healthy()
+	if len(healthy) == 0 {
+		return nil, errNoHealthyUpstream
+	}
+	if candidates := without(healthy, exclude); len(candidates) > 0 {
+		healthy = candidates
+	}
+	switch p.strategy {
+	case strategyRoundRobin:
+		n := atomic.AddUint32(&p.next, 1)
+		return healthy[int(n-1)%len(healthy)], nil
+	case strategyRandom:
+		return healthy[rand.Intn(len(healthy))], nil
+	case strategyFastest:
+		fastest := healthy[0]
+		for _, u := range healthy[1:] {
+			if u.avgLatency() < fastest.avgLatency() {
+				fastest = u
+			}
+		}
+		return fastest, nil
+	default:
+		return healthy[0], nil
+	}
+}
+
+// without is a function to filter upstreams in exclude out of upstreams
+func without(upstreams []*upstream, exclude []*upstream) (rest []*upstream) {
+	for _, u := range upstreams {
+		excluded := false
+		for _, e := range exclude {
+			if u == e {
+				excluded = true
+				break
+			}
+		}
+		if !excluded {
+			rest = append(rest, u)
+		}
+	}
+	return
+}
+
+// exchange is a function to send a query to a healthy upstream and wait at most timeout for its reply
+// upstreams in exclude are avoided if possible, see pick
+// queries are sent over UDP and retried over TCP if the reply is truncated,
+// or sent over TCP at once if p.protocol is "tcp"
+// the reply keeps the Transaction ID chosen by upstream, caller should restore its own
+func (p *upstreamPool) exchange(hdr DNSMsgHdr, qst DNSMsgQst, opt *DNSMsgOPT, timeout time.Duration, exclude ...*upstream) (resp []byte, u *upstream, err error) {
+	u, err = p.pick(exclude...)
+	if err != nil {
+		return nil, nil, err
+	}
+	start := time.Now()
+	if p.protocol == "tcp" {
+		resp, err = u.exchangeTCP(hdr, qst, opt, timeout)
+	} else {
+		resp, err = u.mux.exchange(hdr, qst, opt, timeout)
+		if err == nil && isTruncated(resp) {
+			resp, err = u.exchangeTCP(hdr, qst, opt, timeout)
+		}
+	}
+	u.report(time.Since(start), err, p.maxFails)
+	return resp, u, err
+}
+
+// isTruncated is a function to check TC flag of a reply
+func isTruncated(resp []byte) bool {
+	hdr, err := parseDNSHdr(resp)
+	return err == nil && hdr.parseFlags().TC == 1
+}
+
+// probeQst is the question of health check probes: ". IN NS"
+var probeQst = DNSMsgQst{QNAME: []byte{0x00}, QTYPE: 2, QCLASS: 1}
+
+// probe is a function to send a probe query to u and record whether it's answered in time
+func (p *upstreamPool) probe(u *upstream, timeout time.Duration) {
+	hdr := DNSMsgHdr{FLAGS: 0x0100, QDCOUNT: 1}
+	start := time.Now()
+	_, err := u.mux.exchange(hdr, probeQst, nil, timeout)
+	u.report(time.Since(start), err, p.maxFails)
+}
+
+// healthCheck is a function to probe every upstream each interval until close is called
+func (p *upstreamPool) healthCheck(interval, timeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+		var wg sync.WaitGroup
+		for _, u := range p.upstreams {
+			wg.Add(1)
+			go func(u *upstream) {
+				defer wg.Done()
+				p.probe(u, timeout)
+			}(u)
+		}
+		wg.Wait()
+	}
+}
+
+// close is a function to stop healthCheck and close connections towards every upstream
+func (p *upstreamPool) close() {
+	p.stopOnce.Do(func() {
+		close(p.stop)
+		for _, u := range p.upstreams {
+			u.mux.close()
+		}
+	})
+}
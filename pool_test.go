@@ -0,0 +1,129 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testEchoDNS start a fake remote DNS which echoes every query back with QR set,
+// queries are ignored while *silent is not 0
+func testEchoDNS(t *testing.T, silent *int32) string {
+	return testFakeDNS(t, func(query []byte) []byte {
+		if atomic.LoadInt32(silent) != 0 {
+			return nil
+		}
+		return testEcho(query)
+	})
+}
+
+func TestUpstreamPoolPick(t *testing.T) {
+	a, b, c := newUpstream("a", nil), newUpstream("b", nil), newUpstream("c", nil)
+	a.latency, b.latency, c.latency = 30*time.Millisecond, 10*time.Millisecond, 20*time.Millisecond
+
+	pick := func(pool *upstreamPool) string {
+		u, err := pool.pick()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u.addr
+	}
+
+	pool := newUpstreamPool([]*upstream{a, b, c}, strategyFailover, 1)
+	if got := pick(pool); got != "a" {
+		t.Errorf("failover picks %s, want a", got)
+	}
+	a.healthy = false
+	if got := pick(pool); got != "b" {
+		t.Errorf("failover picks %s while a is ejected, want b", got)
+	}
+	a.healthy = true
+
+	pool = newUpstreamPool([]*upstream{a, b, c}, strategyRoundRobin, 1)
+	for _, want := range []string{"a", "b", "c", "a"} {
+		if got := pick(pool); got != want {
+			t.Errorf("round-robin picks %s, want %s", got, want)
+		}
+	}
+
+	pool = newUpstreamPool([]*upstream{a, b, c}, strategyFastest, 1)
+	if got := pick(pool); got != "b" {
+		t.Errorf("fastest picks %s, want b", got)
+	}
+
+	pool = newUpstreamPool([]*upstream{a, b, c}, strategyRandom, 1)
+	for i := 0; i < 10; i++ {
+		pick(pool)
+	}
+
+	a.healthy, b.healthy, c.healthy = false, false, false
+	if _, err := pool.pick(); err != errNoHealthyUpstream {
+		t.Errorf("pick from a pool without healthy upstream should fail, got %v", err)
+	}
+}
+
+func TestUpstreamPoolEjectAndAdmit(t *testing.T) {
+	silent := int32(1)
+	u := newUpstream("echo", testMux(t, testEchoDNS(t, &silent)))
+	pool := newUpstreamPool([]*upstream{u}, strategyFailover, 2)
+
+	hdr := DNSMsgHdr{ID: 1, FLAGS: 0x0100, QDCOUNT: 1}
+	qst := DNSMsgQst{QNAME: testQNAME("www.ljg.top"), QTYPE: 1, QCLASS: 1}
+	for i := 0; i < 2; i++ {
+		if _, _, err := communicateWithForwardDNS(pool, hdr, qst, nil, retryPolicy{timeout: 20 * time.Millisecond}); err != errUpstreamTimeout {
+			t.Fatalf("query to silent remote DNS should time out, got %v", err)
+		}
+	}
+	if u.isHealthy() {
+		t.Fatal("remote DNS should be ejected after 2 failures")
+	}
+	if _, _, err := communicateWithForwardDNS(pool, hdr, qst, nil, retryPolicy{timeout: 20 * time.Millisecond}); err != errNoHealthyUpstream {
+		t.Errorf("query without healthy remote DNS should fail at once, got %v", err)
+	}
+
+	atomic.StoreInt32(&silent, 0)
+	pool.probe(u, time.Second)
+	if !u.isHealthy() {
+		t.Fatal("remote DNS should be admitted again after a successful probe")
+	}
+	if _, _, err := communicateWithForwardDNS(pool, hdr, qst, nil, retryPolicy{timeout: time.Second}); err != nil {
+		t.Errorf("query to admitted remote DNS failed: %v", err)
+	}
+}
+
+func TestComposeRcode(t *testing.T) {
+	query := DNSMsgHdr{ID: 0x6aec, FLAGS: 0x0100, QDCOUNT: 1, ARCOUNT: 1}
+	qst := DNSMsgQst{QNAME: testQNAME("www.ljg.top"), QTYPE: 1, QCLASS: 1}
+	hdr, _, _, _ := parseDNSRequest(composeRcode(query, qst, 2))
+	flags := hdr.parseFlags()
+	if hdr.ID != 0x6aec || flags.QR != 1 || flags.RCODE != 2 || hdr.ANCOUNT != 0 || hdr.ARCOUNT != 0 {
+		t.Errorf("unexpected SERVFAIL header: %+v, flags: %+v", hdr, flags)
+	}
+}
+
+func TestCommunicateWithForwardDNSRetry(t *testing.T) {
+	silent, echo := int32(1), int32(0)
+	a := newUpstream("silent", testMux(t, testEchoDNS(t, &silent)))
+	b := newUpstream("echo", testMux(t, testEchoDNS(t, &echo)))
+	hdr := DNSMsgHdr{ID: 0x6aec, FLAGS: 0x0100, QDCOUNT: 1}
+	qst := DNSMsgQst{QNAME: testQNAME("www.ljg.top"), QTYPE: 1, QCLASS: 1}
+
+	// the failover pool always picks a first, unless a retry avoids it
+	pool := newUpstreamPool([]*upstream{a, b}, strategyFailover, 10)
+	policy := retryPolicy{timeout: 20 * time.Millisecond, retries: 1, backoff: time.Millisecond, otherUpstream: true}
+	resp, _, err := communicateWithForwardDNS(pool, hdr, qst, nil, policy)
+	if err != nil {
+		t.Fatalf("retry with another remote DNS failed: %v", err)
+	}
+	if respHdr, _, _, _ := parseDNSRequest(resp); respHdr.ID != 0x6aec {
+		t.Errorf("reply ID is %#x, want %#x", respHdr.ID, 0x6aec)
+	}
+
+	policy.otherUpstream = false
+	if _, _, err = communicateWithForwardDNS(pool, hdr, qst, nil, policy); err != errUpstreamTimeout {
+		t.Errorf("retries with the same silent remote DNS should time out, got %v", err)
+	}
+	if a.failures != 3 {
+		t.Errorf("silent remote DNS failed %d times, want 3", a.failures)
+	}
+}
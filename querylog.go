@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// queryLogBuffer is the number of queries waiting to be written to query log,
+// queries beyond it are dropped rather than delay their responses
+const queryLogBuffer = 4096
+
+// queryLogBatch is the size (octet) of entries gathered before they are written to query log in one Write
+const queryLogBatch = 4096
+
+// queryLogEntry is a query recorded by handler, written to query log as a JSON object per line
+// Decision: "hosts", "blocked", "forwarded" or "cached"; Answers: answer section of the response,
+// such as "A 10.0.0.1"; Upstream: remote DNS which answered, for forwarded queries
+type queryLogEntry struct {
+	Time     time.Time `json:"time"`
+	Client   string    `json:"client"`
+	Proto    string    `json:"proto"`
+	QName    string    `json:"qname"`
+	QType    string    `json:"qtype"`
+	Decision string    `json:"decision"`
+	Rcode    string    `json:"rcode"`
+	Answers  []string  `json:"answers,omitempty"`
+	Upstream string    `json:"upstream,omitempty"`
+	Latency  float64   `json:"latency_ms"`
+
+	// resp is the response sent, decoded into Rcode and Answers by the writer rather than by handler
+	resp []byte
+}
+
+// queryLog is a sink of queries, written to a rotating file in its own goroutine
+// record never blocks, so a slow disk drops entries (counted by dropped) instead of delaying responses
+type queryLog struct {
+	// mtx guards entries against being closed while record sends to it
+	mtx     sync.RWMutex
+	closed  bool
+	entries chan queryLogEntry
+	out     *rotatingFile
+	dropped atomic.Uint64
+	done    chan struct{}
+}
+
+// newQueryLog is a function to open query log of cfg, nil is returned if cfg.QueryLog is not set
+func newQueryLog(cfg *Config) (*queryLog, error) {
+	if cfg.QueryLog == "" {
+		return nil, nil
+	}
+	out, err := openRotatingFile(cfg.QueryLog, int64(cfg.QueryLogMaxSize)<<20, cfg.QueryLogRotateInterval.Duration,
+		cfg.QueryLogCompress, cfg.QueryLogMaxBackups, cfg.QueryLogMaxAge.Duration)
+	if err != nil {
+		return nil, err
+	}
+	l := &queryLog{
+		entries: make(chan queryLogEntry, queryLogBuffer),
+		out:     out,
+		done:    make(chan struct{}),
+	}
+	go l.run()
+	return l, nil
+}
+
+// record is a function to queue entry for writing without waiting, a nil queryLog records nothing
+func (l *queryLog) record(entry queryLogEntry) {
+	if l == nil {
+		return
+	}
+	l.mtx.RLock()
+	defer l.mtx.RUnlock()
+	if l.closed {
+		l.dropped.Add(1)
+		return
+	}
+	select {
+	case l.entries <- entry:
+	default:
+		l.dropped.Add(1)
+	}
+}
+
+// run is a function to write entries until close is called
+// entries are gathered in batch, and written once no more entries are waiting;
+// every Write holds whole lines, so rotation never splits an entry across two files
+func (l *queryLog) run() {
+	defer close(l.done)
+	var batch, line bytes.Buffer
+	enc := json.NewEncoder(&line)
+	flush := func() {
+		if batch.Len() == 0 {
+			return
+		}
+		if _, err := l.out.Write(batch.Bytes()); err != nil {
+			slog.Warn("write query log failed", "path", l.out.path, "err", err)
+		}
+		batch.Reset()
+	}
+	for entry := range l.entries {
+		entry.Rcode = rcodeName(respRcode(entry.resp))
+		entry.Answers = answerStrings(entry.resp)
+		line.Reset()
+		if err := enc.Encode(entry); err != nil {
+			slog.Warn("encode query log entry failed", "err", err)
+			continue
+		}
+		if batch.Len()+line.Len() > queryLogBatch {
+			flush()
+		}
+		batch.Write(line.Bytes())
+		if len(l.entries) == 0 {
+			flush()
+		}
+	}
+	flush()
+}
+
+// close is a function to write entries queued so far and close the file, entries recorded later are dropped
+func (l *queryLog) close() error {
+	if l == nil {
+		return nil
+	}
+	l.mtx.Lock()
+	if l.closed {
+		l.mtx.Unlock()
+		return nil
+	}
+	l.closed = true
+	close(l.entries)
+	l.mtx.Unlock()
+	<-l.done
+	if dropped := l.dropped.Load(); dropped > 0 {
+		slog.Warn("query log dropped entries", "path", l.out.path, "dropped", dropped)
+	}
+	return l.out.Close()
+}
+
+// answerStrings is a function to present answer section of resp, such as "A 10.0.0.1" or "CNAME www.example.com",
+// RDATA of other types is in the generic format of RFC-3597, such as "MX \# 4 000a0000"
+func answerStrings(resp []byte) (answers []string) {
+	m, err := unpackDNSMsg(resp)
+	if err != nil {
+		return nil
+	}
+	for _, rr := range m.Asr {
+		var data string
+		switch rr.TYPE {
+		case 1, 28:
+			data = net.IP(rr.RDATA).String()
+		case 2, 5, 12, 39:
+			data = DNSMsgQst{QNAME: rr.RDATA}.parseDomainName()
+		default:
+			data = `\# ` + strconv.Itoa(len(rr.RDATA)) + " " + hex.EncodeToString(rr.RDATA)
+		}
+		answers = append(answers, qtypeName(rr.TYPE)+" "+data)
+	}
+	return
+}
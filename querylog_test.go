@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestQueryLog(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.QueryLog = filepath.Join(t.TempDir(), "query.log")
+	queryLog, err := newQueryLog(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := testRelay("10.0.0.1 www.ljg.top\n2001:db8::1 www.ljg.top\n0.0.0.0 ads.ljg.top\n")
+	r.queryLog = queryLog
+	testExchange(t, r, composeHdrQst(DNSMsgHdr{ID: 1, FLAGS: 0x0100, QDCOUNT: 1},
+		DNSMsgQst{QNAME: testQNAME("www.ljg.top"), QTYPE: 255, QCLASS: 1}))
+	testExchange(t, r, testQuery(2, "ads.ljg.top"))
+	testExchange(t, r, testEDNSQuery(3, "www.ljg.top", DNSMsgOPT{UDPSize: 1232, Version: 1}))
+	if err = queryLog.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(cfg.QueryLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("query log holds %d lines, want 3: %s", len(lines), content)
+	}
+	var entries []queryLogEntry
+	for _, line := range lines {
+		var entry queryLogEntry
+		if err = json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("%s is not a JSON object: %v", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	if e := entries[0]; e.QName != "www.ljg.top" || e.QType != "ANY" || e.Decision != decisionHosts || e.Rcode != "NOERROR" ||
+		!reflect.DeepEqual(e.Answers, []string{"A 10.0.0.1", "AAAA 2001:db8::1"}) || e.Client == "" || e.Time.IsZero() {
+		t.Errorf("unexpected entry %+v", e)
+	}
+	if e := entries[1]; e.QName != "ads.ljg.top" || e.Decision != decisionBlocked || e.Rcode != "NXDOMAIN" || e.Answers != nil {
+		t.Errorf("unexpected entry %+v", e)
+	}
+	if e := entries[2]; e.QName != "www.ljg.top" || e.Decision != decisionRejected || e.Rcode != "BADVERS" {
+		t.Errorf("unexpected entry %+v", e)
+	}
+}
+
+func TestQueryLogRotateBySize(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.QueryLog = filepath.Join(t.TempDir(), "query.log")
+	cfg.QueryLogRotateInterval.Duration = 0
+	cfg.QueryLogMaxBackups = 0
+	queryLog, err := newQueryLog(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// rotate every few batches, each rotated file named by a distinct second
+	start := time.Date(2021, 3, 1, 8, 0, 0, 0, time.UTC)
+	var seconds atomic.Int64
+	queryLog.out.maxSize = 10000
+	queryLog.out.now = func() time.Time {
+		return start.Add(time.Duration(seconds.Add(1)) * time.Second)
+	}
+	const n = 2000
+	for i := 0; i < n; i++ {
+		queryLog.record(queryLogEntry{Time: start, Client: "127.0.0.1:5353", Proto: "udp", QName: "www.ljg.top", QType: "A"})
+	}
+	if err = queryLog.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	backups, err := queryLog.out.backups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) == 0 {
+		t.Fatal("query log is not rotated")
+	}
+	lines := 0
+	for _, path := range append(backups, cfg.QueryLog) {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(content) > 10000 {
+			t.Errorf("%s holds %d octets, over max size", path, len(content))
+		}
+		for _, line := range strings.Split(strings.TrimSuffix(string(content), "\n"), "\n") {
+			var entry queryLogEntry
+			if err = json.Unmarshal([]byte(line), &entry); err != nil {
+				t.Fatalf("%s: %q is not a JSON object: %v", path, line, err)
+			}
+			lines++
+		}
+	}
+	if dropped := int(queryLog.dropped.Load()); lines+dropped != n {
+		t.Errorf("%d entries written and %d dropped, want %d in all", lines, dropped, n)
+	}
+}
+
+func TestQueryLogNonBlocking(t *testing.T) {
+	// nobody writes entries, so the queue fills up and further entries are dropped
+	l := &queryLog{entries: make(chan queryLogEntry, 1)}
+	for i := 0; i < 3; i++ {
+		l.record(queryLogEntry{QName: "www.ljg.top"})
+	}
+	if l.dropped.Load() != 2 {
+		t.Errorf("%d entries dropped, want 2", l.dropped.Load())
+	}
+	// disabled query log
+	var disabled *queryLog
+	disabled.record(queryLogEntry{})
+	if err := disabled.close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAnswerStrings(t *testing.T) {
+	resp := packDNSMsg(DNSMsg{
+		Hdr: DNSMsgHdr{ID: 1, FLAGS: 0x8180},
+		Qst: []DNSMsgQst{{QNAME: testQNAME("www.ljg.top"), QTYPE: 1, QCLASS: 1}},
+		Asr: []DNSMsgRR{
+			{NAME: testQNAME("www.ljg.top"), TYPE: 5, CLASS: 1, TTL: 60, RDLENGTH: 13, RDATA: testQNAME("cdn.ljg.top")},
+			{NAME: testQNAME("cdn.ljg.top"), TYPE: 1, CLASS: 1, TTL: 60, RDLENGTH: 4, RDATA: []byte{10, 0, 0, 1}},
+			{NAME: testQNAME("cdn.ljg.top"), TYPE: 99, CLASS: 1, TTL: 60, RDLENGTH: 2, RDATA: []byte{0xab, 0xcd}},
+		},
+	})
+	want := []string{"CNAME cdn.ljg.top", "A 10.0.0.1", `TYPE99 \# 2 abcd`}
+	if got := answerStrings(resp); !reflect.DeepEqual(got, want) {
+		t.Errorf("answers are %q, want %q", got, want)
+	}
+}
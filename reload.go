@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// hostsSettleDelay is how long to wait after a hosts file changes before reloading it,
+// since an editor may write a file in several steps
+const hostsSettleDelay = 200 * time.Millisecond
+
+// hostsTable holds the hosts store used by handler, which is swapped atomically once hosts files
+// are reloaded, so a query never sees a half-built store, and queries in flight keep the store they began with
+type hostsTable struct {
+	paths    []string
+	store    atomic.Value // *hostsStore
+	mtx      sync.Mutex   // serializes reloads
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// newHostsTable is a function to create hostsTable serving hosts, read from hosts files in paths
+func newHostsTable(paths []string, hosts *hostsStore) *hostsTable {
+	t := &hostsTable{paths: paths, stop: make(chan struct{})}
+	t.store.Store(hosts)
+	return t
+}
+
+// current is a function to get the hosts store in use
+func (t *hostsTable) current() *hostsStore {
+	return t.store.Load().(*hostsStore)
+}
+
+// hostsDiff is a summary of changes between two hosts stores, counted in names
+type hostsDiff struct {
+	added   int
+	removed int
+	changed int
+}
+
+func (d hostsDiff) String() string {
+	return fmt.Sprintf("%d names added, %d removed, %d changed", d.added, d.removed, d.changed)
+}
+
+// diffHosts is a function to compare hosts store before and after a reload,
+// a name is changed if its addresses are not the same any more
+func diffHosts(before, after *hostsStore) (d hostsDiff) {
+	for name, records := range after.names {
+		old, ok := before.names[name]
+		if !ok {
+			d.added++
+		} else if !sameAddrs(old, records) {
+			d.changed++
+		}
+	}
+	for name := range before.names {
+		if _, ok := after.names[name]; !ok {
+			d.removed++
+		}
+	}
+	return
+}
+
+// sameAddrs is a function to check whether a and b hold the same addresses (or block modes) in the same order
+func sameAddrs(a, b []hostsRecord) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].ip != b[i].ip || a[i].block != b[i].block {
+			return false
+		}
+	}
+	return true
+}
+
+// reload is a function to re-parse hosts files and swap the store in use
+// the new store is only used if every file is read without any malformed line,
+// otherwise err is returned and the store in use is kept
+func (t *hostsTable) reload() (d hostsDiff, err error) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	hosts, warnings, err := loadDNSHosts(t.paths)
+	if err != nil {
+		return d, err
+	}
+	if len(warnings) > 0 {
+		return d, fmt.Errorf("%d malformed lines, such as %s", len(warnings), warnings[0])
+	}
+	d = diffHosts(t.current(), hosts)
+	t.store.Store(hosts)
+	return d, nil
+}
+
+// reloadAndLog is a function to reload hosts files and print the result, trigger tells why
+func (t *hostsTable) reloadAndLog(trigger string) {
+	d, err := t.reload()
+	if err != nil {
+		slog.Error("reload hosts failed, keep the old one", "trigger", trigger, "err", err)
+		return
+	}
+	slog.Info("hosts reloaded", "trigger", trigger, "added", d.added, "removed", d.removed, "changed", d.changed, "names", t.current().len())
+}
+
+// watch is a function to reload hosts files on SIGHUP, and once they change if files is set, until close is called
+// changes are noticed by inotify where available, or by polling files every pollInterval
+func (t *hostsTable) watch(files bool, pollInterval time.Duration) {
+	changed := make(chan struct{}, 1)
+	notify := func() {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+	if files {
+		if err := watchInotify(t.paths, t.stop, notify); err != nil {
+			slog.Warn("inotify unavailable, poll hosts files", "interval", pollInterval, "err", err)
+			go pollFiles(t.paths, pollInterval, t.stop, notify)
+		}
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-hup:
+			t.reloadAndLog("SIGHUP")
+		case <-changed:
+			select {
+			case <-t.stop:
+				return
+			case <-time.After(hostsSettleDelay):
+			}
+			// changes during the delay are covered by this reload
+			select {
+			case <-changed:
+			default:
+			}
+			t.reloadAndLog("file changed")
+		}
+	}
+}
+
+// close is a function to stop watch
+func (t *hostsTable) close() {
+	t.stopOnce.Do(func() {
+		close(t.stop)
+	})
+}
+
+// pollFiles is a function to call notify once modification time or size of any file in paths changes,
+// files are checked every interval until stop is closed
+func pollFiles(paths []string, interval time.Duration, stop <-chan struct{}, notify func()) {
+	stat := func() string {
+		var sb strings.Builder
+		for _, path := range paths {
+			if info, err := os.Stat(path); err == nil {
+				fmt.Fprintf(&sb, "%d/%d;", info.ModTime().UnixNano(), info.Size())
+			} else {
+				sb.WriteString("missing;")
+			}
+		}
+		return sb.String()
+	}
+
+	last := stat()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if now := stat(); now != last {
+			last = now
+			notify()
+		}
+	}
+}
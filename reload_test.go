@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testHostsFile write content into a hosts file in a temporary directory and return its path
+func testHostsFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "hosts")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestHostsTableReload(t *testing.T) {
+	path := testHostsFile(t, "10.0.0.1 www.ljg.top\n0.0.0.0 www.bilibili.com\n10.0.0.2 old.ljg.top\n")
+	table := newHostsTable([]string{path}, initDNSHosts([]string{path}))
+	before := table.current()
+
+	if err := ioutil.WriteFile(path, []byte("10.0.0.9 www.ljg.top\n0.0.0.0 www.bilibili.com\n10.0.0.3 new.ljg.top\n10.0.0.4 new2.ljg.top\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	d, err := table.reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d != (hostsDiff{added: 2, removed: 1, changed: 1}) {
+		t.Errorf("diff is %s", d)
+	}
+	if ips, _ := getIPAddrsByDomainName(table.current(), "www.ljg.top"); len(ips) != 1 || ips[0] != "10.0.0.9" {
+		t.Errorf("www.ljg.top maps to %v after reload", ips)
+	}
+	// a store already in use by queries is never modified
+	if ips, _ := getIPAddrsByDomainName(before, "www.ljg.top"); len(ips) != 1 || ips[0] != "10.0.0.1" {
+		t.Errorf("old store changed to %v", ips)
+	}
+
+	// the store in use is kept if new content is malformed or missing
+	reloaded := table.current()
+	if err = ioutil.WriteFile(path, []byte("10.0.0.300 www.ljg.top\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = table.reload(); err == nil {
+		t.Error("reload of a malformed hosts file should fail")
+	}
+	table.paths = []string{filepath.Join(filepath.Dir(path), "missing")}
+	if _, err = table.reload(); err == nil {
+		t.Error("reload of a missing hosts file should fail")
+	}
+	if table.current() != reloaded {
+		t.Error("failed reload should keep the store in use")
+	}
+}
+
+// testWatchReload write a hosts file watched by watch, change it and wait for the reload
+func testWatchReload(t *testing.T, watch func(table *hostsTable)) {
+	path := testHostsFile(t, "10.0.0.1 www.ljg.top\n")
+	table := newHostsTable([]string{path}, initDNSHosts([]string{path}))
+	defer table.close()
+	go watch(table)
+	// let watcher settle before the file changes
+	time.Sleep(50 * time.Millisecond)
+
+	if err := ioutil.WriteFile(path, []byte("10.0.0.2 www.ljg.top\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		if ips, _ := getIPAddrsByDomainName(table.current(), "www.ljg.top"); len(ips) == 1 && ips[0] == "10.0.0.2" {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("hosts file change is not reloaded")
+}
+
+func TestHostsTableWatch(t *testing.T) {
+	// inotify on linux, polling elsewhere
+	testWatchReload(t, func(table *hostsTable) { table.watch(true, 20*time.Millisecond) })
+}
+
+func TestPollFiles(t *testing.T) {
+	testWatchReload(t, func(table *hostsTable) {
+		changed := make(chan struct{}, 1)
+		go pollFiles(table.paths, 20*time.Millisecond, table.stop, func() {
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		})
+		for {
+			select {
+			case <-table.stop:
+				return
+			case <-changed:
+				table.reload()
+			}
+		}
+	})
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupTimeFormat is the suffix of rotated files, such as "query.log.2021-03-01T08-00-00.000",
+// which sorts in time order
+const backupTimeFormat = "2006-01-02T15-04-05.000"
+
+// rotatingFile is an io.WriteCloser appending to the file at path, which is rotated
+// once it would grow over maxSize octets, or once it has been open for interval;
+// rotated files are renamed with the time of rotation, gzipped if compress is set,
+// and removed beyond the newest maxBackups or once older than maxAge (0 keeps them)
+// it's not safe for concurrent use
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	interval   time.Duration
+	compress   bool
+	maxBackups int
+	maxAge     time.Duration
+	now        func() time.Time
+
+	file   *os.File
+	size   int64
+	opened time.Time
+	// background compresses and removes rotated files, one rotation at a time
+	background sync.WaitGroup
+	bgMtx      sync.Mutex
+}
+
+// openRotatingFile is a function to open the file at path for appending, creating it if missing
+func openRotatingFile(path string, maxSize int64, interval time.Duration, compress bool, maxBackups int, maxAge time.Duration) (*rotatingFile, error) {
+	f := &rotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		interval:   interval,
+		compress:   compress,
+		maxBackups: maxBackups,
+		maxAge:     maxAge,
+		now:        time.Now,
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// open is a function to open f.path, an existing file keeps growing until it's rotated
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size, f.opened = file, info.Size(), f.now()
+	return nil
+}
+
+// reopen is a function to open f.path again, the file in use is kept if it fails
+func (f *rotatingFile) reopen() error {
+	old := f.file
+	if err := f.open(); err != nil {
+		return err
+	}
+	return old.Close()
+}
+
+// Write is a function to append p to the file, rotating it first if it's due
+// p is never split across two files, so a caller writing whole lines gets whole lines in every file
+func (f *rotatingFile) Write(p []byte) (n int, err error) {
+	full := f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize
+	old := f.interval > 0 && f.now().Sub(f.opened) >= f.interval
+	if full || old {
+		if err = f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err = f.file.Write(p)
+	f.size += int64(n)
+	return
+}
+
+// rotate is a function to rename the file with the time of rotation and open a new one
+// if the file can't be renamed, such as being removed by hand, there is nothing to back up,
+// so a new one is opened at f.path anyway and the write in progress goes to it
+func (f *rotatingFile) rotate() error {
+	backup := f.path + "." + f.now().Format(backupTimeFormat)
+	if err := os.Rename(f.path, backup); err != nil {
+		slog.Warn("rename rotated file failed, open a new one", "path", f.path, "err", err)
+		return f.reopen()
+	}
+	if err := f.reopen(); err != nil {
+		return err
+	}
+	f.background.Add(1)
+	go func() {
+		defer f.background.Done()
+		f.bgMtx.Lock()
+		defer f.bgMtx.Unlock()
+		if f.compress {
+			if err := gzipFile(backup); err != nil {
+				slog.Warn("compress rotated file failed", "path", backup, "err", err)
+			}
+		}
+		f.removeBackups()
+	}()
+	return nil
+}
+
+// Close is a function to close the file, after rotated files are compressed
+func (f *rotatingFile) Close() error {
+	f.background.Wait()
+	return f.file.Close()
+}
+
+// gzipFile is a function to replace the file at path with path.gz
+func gzipFile(path string) (err error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	if _, err = io.Copy(zw, src); err == nil {
+		err = zw.Close()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
+
+// backups is a function to list rotated files of f, newest first
+func (f *rotatingFile) backups() ([]string, error) {
+	dir, base := filepath.Split(f.path)
+	if dir == "" {
+		dir = "."
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var backups []string
+	for _, entry := range entries {
+		name := entry.Name()
+		stamp := strings.TrimSuffix(strings.TrimPrefix(name, base+"."), ".gz")
+		if !strings.HasPrefix(name, base+".") || len(stamp) != len(backupTimeFormat) {
+			continue
+		}
+		if _, err := time.Parse(backupTimeFormat, stamp); err == nil {
+			backups = append(backups, filepath.Join(dir, name))
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+	return backups, nil
+}
+
+// removeBackups is a function to remove rotated files beyond f.maxBackups, or older than f.maxAge
+func (f *rotatingFile) removeBackups() {
+	if f.maxBackups <= 0 && f.maxAge <= 0 {
+		return
+	}
+	backups, err := f.backups()
+	if err != nil {
+		slog.Warn("list rotated files failed", "path", f.path, "err", err)
+		return
+	}
+	for i, backup := range backups {
+		expired := f.maxBackups > 0 && i >= f.maxBackups
+		if info, err := os.Stat(backup); err == nil && f.maxAge > 0 && f.now().Sub(info.ModTime()) > f.maxAge {
+			expired = true
+		}
+		if expired {
+			if err := os.Remove(backup); err != nil {
+				slog.Warn("remove rotated file failed", "path", backup, "err", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "query.log")
+	f, err := openRotatingFile(path, 10, time.Hour, true, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := time.Date(2021, 3, 1, 8, 0, 0, 0, time.UTC)
+	f.now = func() time.Time { return clock }
+
+	// rotated by size: "0123456789" fills the file, so "a\n" goes to a new one
+	for _, line := range []string{"0123456789", "a\n", "b\n"} {
+		clock = clock.Add(time.Second)
+		if _, err = f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// rotated by time
+	clock = clock.Add(time.Hour)
+	f.Write([]byte("c\n"))
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	backups, err := f.backups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 2 rotations, the oldest one beyond max backups is removed
+	if len(backups) != 1 {
+		t.Fatalf("rotated files are %v, want 1", backups)
+	}
+	for i, want := range []string{"a\nb\n"} {
+		if !strings.HasSuffix(backups[i], ".gz") {
+			t.Errorf("%s is not compressed", backups[i])
+			continue
+		}
+		file, err := os.Open(backups[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		zr, err := gzip.NewReader(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := io.ReadAll(zr)
+		file.Close()
+		if string(content) != want {
+			t.Errorf("%s holds %q, want %q", backups[i], content, want)
+		}
+	}
+	if content, _ := os.ReadFile(path); string(content) != "c\n" {
+		t.Errorf("current file holds %q", content)
+	}
+}
+
+func TestRotatingFileMaxAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "query.log")
+	old := path + "." + time.Now().Add(-48*time.Hour).Format(backupTimeFormat)
+	if err := os.WriteFile(old, []byte("old\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(old, time.Now().Add(-48*time.Hour), time.Now().Add(-48*time.Hour))
+	// other files in the directory are never touched
+	other := path + ".bak"
+	os.WriteFile(other, nil, 0644)
+
+	f, err := openRotatingFile(path, 0, 0, false, 0, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("new\n"))
+	if err = f.rotate(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	backups, _ := f.backups()
+	if len(backups) != 1 || backups[0] == old {
+		t.Errorf("rotated files are %v, %s should be removed", backups, old)
+	}
+	if _, err = os.Stat(other); err != nil {
+		t.Errorf("%s is removed", other)
+	}
+}
+
+func TestRotatingFileRemoved(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "query.log")
+	f, err := openRotatingFile(path, 4, 0, false, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.Write([]byte("a\n"))
+	// removed by hand, so the rotation can't rename it
+	os.Remove(path)
+	// a new file is opened, and the write in progress goes to it instead of being lost
+	if _, err = f.Write([]byte("b\nc\n")); err != nil {
+		t.Fatalf("write during failed rotation: %v", err)
+	}
+	if content, _ := os.ReadFile(path); string(content) != "b\nc\n" {
+		t.Errorf("new file holds %q", content)
+	}
+	// and the new file rotates as usual
+	if _, err = f.Write([]byte("d\n")); err != nil {
+		t.Fatalf("write after failed rotation: %v", err)
+	}
+	if content, _ := os.ReadFile(path); string(content) != "d\n" {
+		t.Errorf("new file holds %q after rotation", content)
+	}
+}
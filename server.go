@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Server is a DNS Relay serving clients over UDP and TCP on every address of cfg.Listen
+// Start opens every socket and begins serving, Shutdown stops it gracefully:
+// no more queries are read, queries in flight are answered, then every resource is released
+type Server struct {
+	cfg    *Config
+	hosts  *hostsTable
+	blocks *blockStore
+
+	relay         *relay
+	clientsConns  []net.PacketConn
+	listeners     []net.Listener
+	metricsServer *http.Server
+	// serving counts goroutines reading queries from clientsConns and accepting from listeners
+	serving      sync.WaitGroup
+	shutdownOnce sync.Once
+}
+
+// NewServer is a function to create a Server answering by hosts and blocks, it's not started yet
+func NewServer(cfg *Config, hosts *hostsTable, blocks *blockStore) *Server {
+	return &Server{cfg: cfg, hosts: hosts, blocks: blocks}
+}
+
+// Start is a function to dial remote DNS, open every socket and serve clients in background goroutines
+// if anything fails, what's opened so far is closed again and err is returned
+func (s *Server) Start() (err error) {
+	cfg := s.cfg
+	// local DNS communicate with remote DNS
+	pool, err := dialUpstreamPool(cfg)
+	if err != nil {
+		return fmt.Errorf("dial remote DNS: %w", err)
+	}
+	s.relay = &relay{
+		cfg:     cfg,
+		hosts:   s.hosts,
+		blocks:  s.blocks,
+		allow:   newAllowlist(cfg.Allowlist),
+		cache:   newAnswerCache(cfg.CacheSize, cfg.MaxNegativeTTL),
+		pool:    pool,
+		closing: make(chan struct{}),
+	}
+	defer func() {
+		if err != nil {
+			s.release()
+		}
+	}()
+	if s.relay.queryLog, err = newQueryLog(cfg); err != nil {
+		return fmt.Errorf("open query log: %w", err)
+	}
+
+	// local DNS run over UDP and TCP, port 53 normally
+	for _, addr := range cfg.Listen {
+		clientsConn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return fmt.Errorf("listen udp: %w", err)
+		}
+		s.clientsConns = append(s.clientsConns, clientsConn)
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			return fmt.Errorf("listen tcp: %w", err)
+		}
+		s.listeners = append(s.listeners, listener)
+	}
+	var metricsListener net.Listener
+	if cfg.MetricsListen != "" {
+		if metricsListener, err = net.Listen("tcp", cfg.MetricsListen); err != nil {
+			return fmt.Errorf("listen metrics: %w", err)
+		}
+		s.metricsServer = &http.Server{Handler: metricsHandler(relayMetrics)}
+	}
+
+	go pool.healthCheck(cfg.HealthCheckInterval.Duration, cfg.UpstreamTimeout.Duration)
+	go s.hosts.watch(cfg.WatchHosts, cfg.HostsPollInterval.Duration)
+	warnSinkhole(s.hosts.current(), cfg.Sinkhole)
+	if s.blocks != nil {
+		warnSinkhole(s.blocks.blocked, cfg.Sinkhole)
+	}
+	if s.metricsServer != nil {
+		go s.metricsServer.Serve(metricsListener)
+	}
+	for _, clientsConn := range s.clientsConns {
+		s.serving.Add(1)
+		go func(clientsConn net.PacketConn) {
+			defer s.serving.Done()
+			s.relay.serve(clientsConn)
+		}(clientsConn)
+	}
+	for _, listener := range s.listeners {
+		s.serving.Add(1)
+		go func(listener net.Listener) {
+			defer s.serving.Done()
+			s.relay.serveTCP(listener)
+		}(listener)
+	}
+	slog.Info("DNS Relay started", "listen", cfg.Listen, "upstreams", cfg.Upstreams)
+	return nil
+}
+
+// Shutdown is a function to stop reading queries, wait for queries in flight, and release every resource
+// if ctx is done before queries in flight are answered, they are abandoned and ctx.Err() is returned,
+// resources are released anyway; Shutdown of a Server not started or already shut down does nothing
+func (s *Server) Shutdown(ctx context.Context) (err error) {
+	if s.relay == nil {
+		return nil
+	}
+	s.shutdownOnce.Do(func() {
+		close(s.relay.closing)
+		// a read in progress returns at once, and serve sees closing
+		for _, clientsConn := range s.clientsConns {
+			clientsConn.SetReadDeadline(time.Now())
+		}
+		for _, listener := range s.listeners {
+			listener.Close()
+		}
+		s.relay.interruptConns()
+
+		drained := make(chan struct{})
+		go func() {
+			s.serving.Wait()
+			s.relay.handlers.Wait()
+			close(drained)
+		}()
+		select {
+		case <-drained:
+		case <-ctx.Done():
+			err = ctx.Err()
+			slog.Warn("shutdown deadline exceeded, abandon queries in flight", "in_flight", relayMetrics.inFlight.Load())
+		}
+		if s.metricsServer != nil {
+			s.metricsServer.Shutdown(ctx)
+		}
+		if closeErr := s.release(); err == nil {
+			err = closeErr
+		}
+		slog.Info("DNS Relay stopped")
+	})
+	return err
+}
+
+// release is a function to close every socket, stop background goroutines and flush query log
+func (s *Server) release() error {
+	if s.metricsServer != nil {
+		s.metricsServer.Close()
+	}
+	for _, listener := range s.listeners {
+		listener.Close()
+	}
+	s.relay.closeConns()
+	for _, clientsConn := range s.clientsConns {
+		clientsConn.Close()
+	}
+	s.hosts.close()
+	s.relay.pool.close()
+	if err := s.relay.queryLog.close(); err != nil {
+		return fmt.Errorf("close query log: %w", err)
+	}
+	return nil
+}
+
+// udpAddrs is a function to get addresses clients reach the server at over UDP
+func (s *Server) udpAddrs() (addrs []net.Addr) {
+	for _, clientsConn := range s.clientsConns {
+		addrs = append(addrs, clientsConn.LocalAddr())
+	}
+	return
+}
+
+// tcpAddrs is a function to get addresses clients reach the server at over TCP
+func (s *Server) tcpAddrs() (addrs []net.Addr) {
+	for _, listener := range s.listeners {
+		addrs = append(addrs, listener.Addr())
+	}
+	return
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// testSlowDNS start a fake remote DNS which echoes every query back with QR set after delay
+func testSlowDNS(t *testing.T, delay time.Duration) string {
+	return testFakeDNS(t, func(query []byte) []byte {
+		time.Sleep(delay)
+		return testEcho(query)
+	})
+}
+
+// testServer start a Server on a random port of localhost forwarding to upstream
+func testServer(t *testing.T, upstream string) *Server {
+	cfg := defaultConfig()
+	cfg.Listen = []string{"127.0.0.1:0"}
+	cfg.Upstreams = []string{upstream}
+	cfg.WatchHosts = false
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(cfg, newHostsTable(nil, newHostsStore(nil)), nil)
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return srv
+}
+
+func TestServerShutdown(t *testing.T) {
+	srv := testServer(t, testSlowDNS(t, 200*time.Millisecond))
+
+	udpClient, err := net.Dial("udp", srv.udpAddrs()[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpClient.Close()
+	tcpClient, err := net.Dial("tcp", srv.tcpAddrs()[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpClient.Close()
+	udpClient.Write(testQuery(1, "www.ljg.top"))
+	writeTCPMsg(tcpClient, testQuery(2, "www.ljg.top"))
+	// let the server read both queries, which are waiting for remote DNS
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err = srv.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown failed: %v", err)
+	}
+
+	// queries in flight are answered before shutdown returns
+	udpClient.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 512)
+	if n, err := udpClient.Read(buf); err != nil {
+		t.Errorf("udp query in flight is not answered: %v", err)
+	} else if hdr, _ := parseDNSHdr(buf[:n]); hdr.ID != 1 {
+		t.Errorf("udp response ID %d, want 1", hdr.ID)
+	}
+	tcpClient.SetReadDeadline(time.Now().Add(time.Second))
+	if resp, err := readTCPMsg(tcpClient); err != nil {
+		t.Errorf("tcp query in flight is not answered: %v", err)
+	} else if hdr, _ := parseDNSHdr(resp); hdr.ID != 2 {
+		t.Errorf("tcp response ID %d, want 2", hdr.ID)
+	}
+	// then the connection is closed
+	if _, err = readTCPMsg(tcpClient); err == nil {
+		t.Error("tcp connection is still open after shutdown")
+	}
+	if _, err = net.Dial("tcp", srv.tcpAddrs()[0].String()); err == nil {
+		t.Error("tcp listener is still open after shutdown")
+	}
+	// shutdown twice does nothing
+	if err = srv.Shutdown(ctx); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestServerStartFailed(t *testing.T) {
+	occupied, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer occupied.Close()
+
+	cfg := defaultConfig()
+	cfg.Listen = []string{occupied.Addr().String()}
+	cfg.Upstreams = []string{testSlowDNS(t, 0)}
+	srv := NewServer(cfg, newHostsTable(nil, newHostsStore(nil)), nil)
+	if err = srv.Start(); err == nil {
+		t.Fatal("start on an address in use should fail")
+	}
+	// the udp socket opened before is closed again
+	if conn, err := net.ListenPacket("udp", occupied.Addr().String()); err != nil {
+		t.Errorf("udp socket is not released: %v", err)
+	} else {
+		conn.Close()
+	}
+}
+
+func TestServerShutdownDeadline(t *testing.T) {
+	srv := testServer(t, testSlowDNS(t, time.Second))
+	client, err := net.Dial("udp", srv.udpAddrs()[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Write(testQuery(1, "www.ljg.top"))
+	time.Sleep(50 * time.Millisecond)
+
+	writeErrors := testSocketErrors("write")
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err = srv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("shutdown should give up on the query in flight, got %v", err)
+	}
+	// the abandoned query is answered on a closed socket, which must not bring the process down
+	srv.relay.handlers.Wait()
+	if testSocketErrors("write") != writeErrors+1 {
+		t.Error("failed write of the abandoned query is not counted")
+	}
+}
+
+// testWriter is a respWriter failing every write with err, or panicking if err is nil
+type testWriter struct {
+	err error
+}
+
+func (w testWriter) write(resp []byte) error {
+	if w.err == nil {
+		panic("test panic")
+	}
+	return w.err
+}
+
+func (w testWriter) remoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}
+}
+
+func (w testWriter) network() string { return "udp" }
+
+// testSocketErrors get the number of failed op on sockets of clients so far
+func testSocketErrors(op string) uint64 {
+	relayMetrics.mtx.Lock()
+	defer relayMetrics.mtx.Unlock()
+	return relayMetrics.socketErrors[op]
+}
+
+func TestHandlerFailure(t *testing.T) {
+	r := testRelay("10.0.0.1 www.ljg.top\n")
+	writeErrors, panics := testSocketErrors("write"), relayMetrics.panics.Load()
+
+	r.goHandler(&safeBuf{buf: testQuery(1, "www.ljg.top")}, testWriter{err: errors.New("network is unreachable")}, func() {})
+	r.handlers.Wait()
+	if testSocketErrors("write") != writeErrors+1 {
+		t.Error("failed write is not counted")
+	}
+
+	done := false
+	r.goHandler(&safeBuf{buf: testQuery(2, "www.ljg.top")}, testWriter{}, func() { done = true })
+	r.handlers.Wait()
+	if relayMetrics.panics.Load() != panics+1 || !done {
+		t.Error("panic of handler is not recovered")
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// respWriter sends the response of a query back to its client,
+// over UDP as a single datagram, or over TCP with a two-octet length prefix
+type respWriter interface {
+	write(resp []byte) error
+	remoteAddr() net.Addr
+	network() string
+}
+
+// udpWriter is a respWriter answering a datagram read from clientsConn
+// responses over limit octets are truncated, see truncateMsg
+type udpWriter struct {
+	clientsConn net.PacketConn
+	addr        net.Addr
+	limit       int
+}
+
+func (w udpWriter) write(resp []byte) error {
+	_, err := w.clientsConn.WriteTo(truncateMsg(resp, w.limit), w.addr)
+	return err
+}
+
+func (w udpWriter) remoteAddr() net.Addr { return w.addr }
+
+func (w udpWriter) network() string { return "udp" }
+
+// tcpWriter is a respWriter answering a query read from a TCP connection,
+// queries on a connection are pipelined, so writes of their responses are serialized by mtx
+type tcpWriter struct {
+	conn net.Conn
+	mtx  *sync.Mutex
+}
+
+func (w tcpWriter) write(resp []byte) error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	return writeTCPMsg(w.conn, resp)
+}
+
+func (w tcpWriter) remoteAddr() net.Addr { return w.conn.RemoteAddr() }
+
+func (w tcpWriter) network() string { return "tcp" }
+
+// errLongTCPMsg is returned when a message can't be described by the two-octet length prefix
+var errLongTCPMsg = errors.New("DNS message over 65535 octets")
+
+// writeTCPMsg is a function to write msg prefixed by its two-octet length, RFC-1035 4.2.2
+func writeTCPMsg(conn net.Conn, msg []byte) error {
+	if len(msg) > 0xffff {
+		return errLongTCPMsg
+	}
+	framed := make([]byte, 2, 2+len(msg))
+	binary.BigEndian.PutUint16(framed, uint16(len(msg)))
+	_, err := conn.Write(append(framed, msg...))
+	return err
+}
+
+// readTCPMsg is a function to read a message prefixed by its two-octet length
+func readTCPMsg(conn net.Conn) (msg []byte, err error) {
+	length := make([]byte, 2)
+	if _, err = io.ReadFull(conn, length); err != nil {
+		return nil, err
+	}
+	msg = make([]byte, binary.BigEndian.Uint16(length))
+	if _, err = io.ReadFull(conn, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// serveTCP is a function to accept TCP connections from clients and serve each in a goroutine, until shutdown
+func (r *relay) serveTCP(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if r.isClosing() || errors.Is(err, net.ErrClosed) {
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+		if err != nil {
+			// such as running out of file descriptors, which may be released soon
+			slog.Warn("accept tcp clients failed", "err", err)
+			relayMetrics.socketError("accept")
+			time.Sleep(tcpAcceptBackoff)
+			continue
+		}
+		slog.Debug("tcp connection", "client", conn.RemoteAddr().String())
+		r.handlers.Add(1)
+		go func() {
+			defer r.handlers.Done()
+			defer recoverPanic("tcp connection", "client", conn.RemoteAddr().String())
+			r.serveTCPConn(conn)
+		}()
+	}
+}
+
+// tcpAcceptBackoff is the pause after accept fails, so a lasting failure doesn't spin
+const tcpAcceptBackoff = 10 * time.Millisecond
+
+// trackConn is a function to remember conn being served, or forget it once done,
+// so shutdown can interrupt reading queries from it
+func (r *relay) trackConn(conn net.Conn, serving bool) {
+	r.connsMtx.Lock()
+	defer r.connsMtx.Unlock()
+	if r.conns == nil {
+		r.conns = make(map[net.Conn]struct{})
+	}
+	if serving {
+		r.conns[conn] = struct{}{}
+	} else {
+		delete(r.conns, conn)
+	}
+}
+
+// interruptConns is a function to stop reading queries from every TCP connection being served,
+// while responses to queries read so far are still written
+func (r *relay) interruptConns() {
+	r.connsMtx.Lock()
+	defer r.connsMtx.Unlock()
+	for conn := range r.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+}
+
+// closeConns is a function to close every TCP connection being served
+func (r *relay) closeConns() {
+	r.connsMtx.Lock()
+	defer r.connsMtx.Unlock()
+	for conn := range r.conns {
+		conn.Close()
+	}
+}
+
+// serveTCPConn is a function to read pipelined queries from a TCP connection, RFC-7766
+// every query is handled in its own goroutine, and responses are written once ready,
+// the connection is closed after staying idle for cfg.TCPIdleTimeout
+func (r *relay) serveTCPConn(conn net.Conn) {
+	var wg sync.WaitGroup
+	r.trackConn(conn, true)
+	defer func() {
+		// wait for pipelined queries before closing, so their responses are not lost
+		wg.Wait()
+		r.trackConn(conn, false)
+		conn.Close()
+	}()
+
+	w := tcpWriter{conn: conn, mtx: new(sync.Mutex)}
+	for {
+		conn.SetReadDeadline(time.Now().Add(r.cfg.TCPIdleTimeout.Duration))
+		// checked after the deadline is set, so it never overrides the one set by interruptConns
+		if r.isClosing() {
+			return
+		}
+		msg, err := readTCPMsg(conn)
+		if err != nil {
+			return
+		}
+		sbuf := &safeBuf{buf: msg}
+		wg.Add(1)
+		r.goHandler(sbuf, w, wg.Done)
+	}
+}
+
+// exchangeTCP is a function to send a query to remote DNS over a new TCP connection
+// and wait at most timeout for its reply, used when the reply over UDP is truncated
+// the reply keeps the Transaction ID chosen here, caller should restore its own
+func (u *upstream) exchangeTCP(hdr DNSMsgHdr, qst DNSMsgQst, opt *DNSMsgOPT, timeout time.Duration) (resp []byte, err error) {
+	conn, err := net.DialTimeout("tcp", u.addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	hdr.ID = randomID()
+	if err = writeTCPMsg(conn, composeQuery(hdr, qst, opt)); err != nil {
+		return nil, err
+	}
+	for {
+		if resp, err = readTCPMsg(conn); err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				return nil, errUpstreamTimeout
+			}
+			return nil, err
+		}
+		respHdr, respQst, _, err := parseDNSRequest(resp)
+		if err == nil && newPendingKey(respHdr.ID, respQst) == newPendingKey(hdr.ID, qst) {
+			return resp, nil
+		}
+	}
+}
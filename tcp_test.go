@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testRelay create relay answering from hosts only, without remote DNS
+// hosts is the content of a hosts file
+func testRelay(hosts string) *relay {
+	cfg := defaultConfig()
+	cfg.Verbose = false
+	entries, _, _ := parseHosts(strings.NewReader(hosts), "test")
+	return &relay{
+		cfg:   cfg,
+		hosts: newHostsTable(nil, newHostsStore(entries)),
+		allow: newAllowlist(nil),
+		cache: newAnswerCache(cfg.CacheSize, cfg.MaxNegativeTTL),
+	}
+}
+
+// testQuery compose a query of domainName with QTYPE A
+func testQuery(id uint16, domainName string) []byte {
+	hdr := DNSMsgHdr{ID: id, FLAGS: 0x0100, QDCOUNT: 1}
+	return composeHdrQst(hdr, DNSMsgQst{QNAME: testQNAME(domainName), QTYPE: 1, QCLASS: 1})
+}
+
+// testExchange send query to r over a TCP connection and return the unpacked response
+func testExchange(t *testing.T, r *relay, query []byte) DNSMsg {
+	t.Helper()
+	client, server := net.Pipe()
+	defer client.Close()
+	go r.serveTCPConn(server)
+	client.SetDeadline(time.Now().Add(time.Second))
+
+	if err := writeTCPMsg(client, query); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := readTCPMsg(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := unpackDNSMsg(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestTCPMsgFraming(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	msg := testQuery(0x6aec, "www.ljg.top")
+	go writeTCPMsg(client, msg)
+	got, err := readTCPMsg(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Errorf("read %v, want %v", got, msg)
+	}
+	if err := writeTCPMsg(client, make([]byte, 0x10000)); err != errLongTCPMsg {
+		t.Errorf("message over 65535 octets should be rejected, got %v", err)
+	}
+}
+
+func TestServeTCPConnPipelining(t *testing.T) {
+	r := testRelay("10.0.0.1 www.ljg.top\n0.0.0.0 www.bilibili.com\n")
+	client, server := net.Pipe()
+	defer client.Close()
+	go r.serveTCPConn(server)
+
+	// both queries are written before any response is read
+	go func() {
+		writeTCPMsg(client, testQuery(1, "www.ljg.top"))
+		writeTCPMsg(client, testQuery(2, "www.bilibili.com"))
+	}()
+	rcodes := make(map[uint16]uint8)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	for i := 0; i < 2; i++ {
+		resp, err := readTCPMsg(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hdr, err := parseDNSHdr(resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rcodes[hdr.ID] = hdr.parseFlags().RCODE
+	}
+	if rcode, ok := rcodes[1]; !ok || rcode != 0 {
+		t.Errorf("query 1 should be answered by hosts, got %v", rcodes)
+	}
+	if rcode, ok := rcodes[2]; !ok || rcode != 3 {
+		t.Errorf("query 2 should be blocked, got %v", rcodes)
+	}
+}
+
+func TestServeTCPConnIdleTimeout(t *testing.T) {
+	r := testRelay("")
+	r.cfg.TCPIdleTimeout.Duration = 20 * time.Millisecond
+	client, server := net.Pipe()
+	defer client.Close()
+
+	done := make(chan struct{})
+	go func() {
+		r.serveTCPConn(server)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("idle TCP connection is not closed")
+	}
+}
+
+// testTruncatingDNS start a fake remote DNS answering over UDP with TC set and no answer,
+// and over TCP with a complete answer, both on the same port
+func testTruncatingDNS(t *testing.T) (addr string, tcpQueries *int32) {
+	tcpQueries = new(int32)
+	var listener net.Listener
+	for {
+		addr = testFakeDNS(t, func(query []byte) []byte {
+			query[2] |= 0x82
+			return query
+		})
+		var err error
+		if listener, err = net.Listen("tcp", addr); err == nil {
+			break
+		}
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(tcpQueries, 1)
+			query, err := readTCPMsg(conn)
+			if err == nil {
+				hdr, qst, _, _ := parseDNSRequest(query)
+				hdr.FLAGS, hdr.ANCOUNT = 0x8180, 1
+				writeTCPMsg(conn, composeHdrQstAsr(hdr, qst, createDNSMsgAsr(1, 1, 60, 4, "10.0.0.1")))
+			}
+			conn.Close()
+		}
+	}()
+	return addr, tcpQueries
+}
+
+func TestUpstreamTCPFallback(t *testing.T) {
+	addr, tcpQueries := testTruncatingDNS(t)
+	u, err := dialUpstream(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.mux.close()
+	pool := newUpstreamPool([]*upstream{u}, strategyFailover, 3)
+
+	hdr := DNSMsgHdr{ID: 0x6aec, FLAGS: 0x0100, QDCOUNT: 1}
+	qst := DNSMsgQst{QNAME: testQNAME("www.ljg.top"), QTYPE: 1, QCLASS: 1}
+	resp, _, err := communicateWithForwardDNS(pool, hdr, qst, nil, retryPolicy{timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	respHdr, _ := testUnpack(t, resp)
+	if respHdr.ID != 0x6aec || respHdr.parseFlags().TC != 0 || respHdr.ANCOUNT != 1 {
+		t.Errorf("truncated reply should be retried over TCP, got %+v", respHdr)
+	}
+	if atomic.LoadInt32(tcpQueries) != 1 {
+		t.Errorf("remote DNS got %d queries over TCP, want 1", atomic.LoadInt32(tcpQueries))
+	}
+
+	pool.protocol = "tcp"
+	if _, _, err = communicateWithForwardDNS(pool, hdr, qst, nil, retryPolicy{timeout: time.Second}); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(tcpQueries) != 2 {
+		t.Errorf("remote DNS got %d queries over TCP, want 2", atomic.LoadInt32(tcpQueries))
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import "strings"
+
+// labelTrie is a trie of domain names keyed by labels in reversed order,
+// such as "ads.example.com" stored as com -> example -> ads, so rules covering
+// a suffix of a name are found by walking its labels from the root zone
+// wildcard: records of "*.name", matching strict subdomains of the node
+// zone: records of ".name", matching the node itself and its subdomains
+type labelTrie struct {
+	children map[string]*labelTrie
+	wildcard []hostsRecord
+	zone     []hostsRecord
+}
+
+// wildcardPrefix and zonePrefix mark rules of hosts files matching more than one name
+const (
+	wildcardPrefix = "*."
+	zonePrefix     = "."
+)
+
+// newLabelTrie is a function to create an empty labelTrie
+func newLabelTrie() *labelTrie {
+	return &labelTrie{children: make(map[string]*labelTrie)}
+}
+
+// reversedLabels is a function to split a canonical name into labels from the root zone,
+// "ads.example.com" => ["com", "example", "ads"]
+func reversedLabels(name string) (labels []string) {
+	labels = strings.Split(name, ".")
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return
+}
+
+// insert is a function to remember records of rule, which is "*.name" or ".name" in canonical form
+func (t *labelTrie) insert(rule string, records []hostsRecord) {
+	wildcard := strings.HasPrefix(rule, wildcardPrefix)
+	name := strings.TrimPrefix(strings.TrimPrefix(rule, wildcardPrefix), zonePrefix)
+	node := t
+	for _, label := range reversedLabels(name) {
+		child, ok := node.children[label]
+		if !ok {
+			child = newLabelTrie()
+			node.children[label] = child
+		}
+		node = child
+	}
+	if wildcard {
+		node.wildcard = records
+	} else {
+		node.zone = records
+	}
+}
+
+// match is a function to find the rule covering the longest suffix of canonical name
+// at the same depth, "*.name" is preferred to ".name" for subdomains, while only ".name" covers name itself
+func (t *labelTrie) match(name string) (rule string, records []hostsRecord, ok bool) {
+	labels := reversedLabels(name)
+	node := t
+	for depth, label := range labels {
+		if node = node.children[label]; node == nil {
+			break
+		}
+		matched := depth + 1
+		if matched < len(labels) && node.wildcard != nil {
+			rule, records, ok = wildcardPrefix+joinReversed(labels[:matched]), node.wildcard, true
+		} else if node.zone != nil {
+			rule, records, ok = zonePrefix+joinReversed(labels[:matched]), node.zone, true
+		}
+	}
+	return
+}
+
+// joinReversed is a function to turn reversed labels back into a domain name
+func joinReversed(labels []string) string {
+	parts := make([]string, len(labels))
+	for i, label := range labels {
+		parts[len(labels)-1-i] = label
+	}
+	return strings.Join(parts, ".")
+}
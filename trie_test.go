@@ -0,0 +1,61 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHostsStoreMatch(t *testing.T) {
+	entries, warnings, _ := parseHosts(strings.NewReader(strings.Join([]string{
+		"0.0.0.0 *.doubleclick.net",
+		"10.0.0.1 .example.com",
+		"10.0.0.2 *.cdn.example.com",
+		"10.0.0.3 www.cdn.example.com",
+		"10.0.0.4 .static.cdn.example.com",
+		"10.0.0.5 *.",
+	}, "\n")), "test.hosts")
+	if len(warnings) != 1 {
+		t.Errorf("bare wildcard should be a warning, got %q", warnings)
+	}
+	hosts := newHostsStore(entries)
+
+	cases := []struct {
+		name string
+		rule string
+		ip   string
+	}{
+		{"ad.doubleclick.net", "*.doubleclick.net", "0.0.0.0"},
+		{"a.b.c.DoubleClick.net.", "*.doubleclick.net", "0.0.0.0"},
+		{"doubleclick.net", "", ""},
+		{"example.com", ".example.com", "10.0.0.1"},
+		{"www.example.com", ".example.com", "10.0.0.1"},
+		{"cdn.example.com", ".example.com", "10.0.0.1"},
+		{"img.cdn.example.com", "*.cdn.example.com", "10.0.0.2"},
+		{"www.cdn.example.com", "www.cdn.example.com", "10.0.0.3"},
+		{"static.cdn.example.com", ".static.cdn.example.com", "10.0.0.4"},
+		{"a.static.cdn.example.com", ".static.cdn.example.com", "10.0.0.4"},
+		{"example.org", "", ""},
+	}
+	for _, c := range cases {
+		ips, rule := getIPAddrsByDomainName(hosts, c.name)
+		if rule != c.rule {
+			t.Errorf("%s matches rule %q, want %q", c.name, rule, c.rule)
+		}
+		if c.ip == "" && ips != nil || c.ip != "" && (len(ips) != 1 || ips[0] != c.ip) {
+			t.Errorf("%s maps to %v, want %s", c.name, ips, c.ip)
+		}
+	}
+}
+
+func BenchmarkHostsStoreMatch(b *testing.B) {
+	var sb strings.Builder
+	sb.WriteString(testLargeHosts(1000000))
+	sb.WriteString("0.0.0.0 *.tracker.example.com\n")
+	entries, _, _ := parseHosts(strings.NewReader(sb.String()), "bench.hosts")
+	hosts := newHostsStore(entries)
+	names := []string{"ad999999.tracker.example.com", "x.y.tracker.example.com", "www.ljg.top"}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		hosts.match(names[i%len(names)])
+	}
+}
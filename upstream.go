@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pendingKey identifies an outstanding query sent to remote DNS.
+// a reply is only accepted if both its ID and its question match,
+// so a forged or late packet with a reused ID cannot be delivered to the wrong client
+type pendingKey struct {
+	id     uint16
+	qname  string
+	qtype  uint16
+	qclass uint16
+}
+
+// newPendingKey build the key of a query from its ID and question,
+// QNAME is compared case-insensitively since some servers echo it with another case
+func newPendingKey(id uint16, qst DNSMsgQst) pendingKey {
+	return pendingKey{
+		id:     id,
+		qname:  strings.ToLower(string(qst.QNAME)),
+		qtype:  qst.QTYPE,
+		qclass: qst.QCLASS,
+	}
+}
+
+// upstreamMux is a multiplexer over a single UDP connection towards remote DNS
+// every query sent through it gets a fresh random Transaction ID,
+// and readLoop dispatches each reply to the goroutine waiting for it
+type upstreamMux struct {
+	conn    *net.UDPConn
+	mtx     sync.Mutex
+	pending map[pendingKey]chan []byte
+	closed  bool
+}
+
+// newUpstreamMux is a function to create upstreamMux and start its readLoop
+func newUpstreamMux(conn *net.UDPConn) (mux *upstreamMux) {
+	mux = &upstreamMux{
+		conn:    conn,
+		pending: make(map[pendingKey]chan []byte),
+	}
+	go mux.readLoop()
+	return
+}
+
+// randomID is a function to generate an unpredictable 16-bit Transaction ID
+func randomID() uint16 {
+	b := make([]byte, 2)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return binary.BigEndian.Uint16(b)
+}
+
+// register is a function to reserve a Transaction ID not used by any outstanding query
+// with the same question, and return the channel on which the reply will arrive
+func (mux *upstreamMux) register(qst DNSMsgQst) (key pendingKey, ch chan []byte) {
+	ch = make(chan []byte, 1)
+	mux.mtx.Lock()
+	defer mux.mtx.Unlock()
+	for {
+		key = newPendingKey(randomID(), qst)
+		if _, ok := mux.pending[key]; !ok {
+			mux.pending[key] = ch
+			return
+		}
+	}
+}
+
+// unregister is a function to release a Transaction ID reserved by register
+func (mux *upstreamMux) unregister(key pendingKey) {
+	mux.mtx.Lock()
+	delete(mux.pending, key)
+	mux.mtx.Unlock()
+}
+
+// errUpstreamTimeout is returned when remote DNS doesn't answer in time
+var errUpstreamTimeout = errors.New("remote DNS timeout")
+
+// exchange is a function to send a query to remote DNS and wait at most timeout for its reply
+// opt is put in additional section of the query if it's not nil
+// the reply keeps the Transaction ID chosen by mux, caller should restore its own
+func (mux *upstreamMux) exchange(hdr DNSMsgHdr, qst DNSMsgQst, opt *DNSMsgOPT, timeout time.Duration) (resp []byte, err error) {
+	key, ch := mux.register(qst)
+	defer mux.unregister(key)
+
+	hdr.ID = key.id
+	relay := composeQuery(hdr, qst, opt)
+	if _, err = mux.conn.Write(relay); err != nil {
+		return nil, err
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			return nil, errors.New("connection to remote DNS closed")
+		}
+		return resp, nil
+	case <-timer.C:
+		return nil, errUpstreamTimeout
+	}
+}
+
+// readLoop is a function to read replies from remote DNS and dispatch them
+// replies matching no outstanding query are dropped
+func (mux *upstreamMux) readLoop() {
+	// read whole datagram, so large replies are never cut silently
+	buf := make([]byte, maxUDPSize)
+	for {
+		n, err := mux.conn.Read(buf)
+		if err != nil {
+			if mux.isClosed() {
+				mux.closeAll()
+				return
+			}
+			slog.Warn("read from remote DNS failed", "upstream", mux.conn.RemoteAddr().String(), "err", err)
+			continue
+		}
+		hdr, qst, _, err := parseDNSRequest(buf[:n])
+		if err != nil {
+			slog.Warn("drop malformed reply from remote DNS", "upstream", mux.conn.RemoteAddr().String(), "err", err)
+			relayMetrics.parseError("upstream")
+			relayMetrics.drop(dropMalformedReply)
+			continue
+		}
+		key := newPendingKey(hdr.ID, qst)
+
+		mux.mtx.Lock()
+		ch, ok := mux.pending[key]
+		if ok {
+			delete(mux.pending, key)
+		}
+		mux.mtx.Unlock()
+
+		if !ok {
+			slog.Warn("drop unexpected reply from remote DNS", "upstream", mux.conn.RemoteAddr().String(), "id", hdr.ID)
+			relayMetrics.drop(dropUnexpectedReply)
+			continue
+		}
+		resp := make([]byte, n)
+		copy(resp, buf[:n])
+		ch <- resp
+	}
+}
+
+// close is a function to close the connection towards remote DNS and stop readLoop
+func (mux *upstreamMux) close() error {
+	mux.mtx.Lock()
+	mux.closed = true
+	mux.mtx.Unlock()
+	return mux.conn.Close()
+}
+
+// isClosed is a function to check whether close has been called
+func (mux *upstreamMux) isClosed() bool {
+	mux.mtx.Lock()
+	defer mux.mtx.Unlock()
+	return mux.closed
+}
+
+// closeAll is a function to wake up every goroutine waiting for a reply
+// once the connection towards remote DNS is closed
+func (mux *upstreamMux) closeAll() {
+	mux.mtx.Lock()
+	defer mux.mtx.Unlock()
+	for key, ch := range mux.pending {
+		close(ch)
+		delete(mux.pending, key)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testQNAME is a helper to translate "google.com" into QNAME octets
+func testQNAME(domainName string) (qname []byte) {
+	for _, label := range strings.Split(domainName, ".") {
+		qname = append(qname, byte(len(label)))
+		qname = append(qname, label...)
+	}
+	return append(qname, 0x00)
+}
+
+// testFakeDNS start a fake remote DNS on a random UDP port of localhost and return its address,
+// every query is answered by what reply returns in a goroutine of its own, or ignored if it's nil
+func testFakeDNS(t *testing.T, reply func(query []byte) []byte) string {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+
+	go func() {
+		for {
+			buf := make([]byte, 512)
+			length, from, err := server.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			go func() {
+				if resp := reply(buf[:length]); resp != nil {
+					server.WriteTo(resp, from)
+				}
+			}()
+		}
+	}()
+	return server.LocalAddr().String()
+}
+
+// testEcho is a reply of testFakeDNS, which echoes query back with QR set
+func testEcho(query []byte) []byte {
+	query[2] |= 0x80
+	return query
+}
+
+// testMux create upstreamMux towards the remote DNS at addr, which is closed once the test finishes
+func testMux(t *testing.T, addr string) *upstreamMux {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.DialUDP("udp", nil, udpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := newUpstreamMux(conn)
+	t.Cleanup(func() { mux.close() })
+	return mux
+}
+
+func TestUpstreamMuxDispatch(t *testing.T) {
+	domainNames := []string{"google.com", "www.bilibili.com", "tools.ietf.org"}
+	// every reply is held until all queries arrive, then the latest query is answered first
+	var arrived sync.WaitGroup
+	arrived.Add(len(domainNames))
+	var count int32
+	mux := testMux(t, testFakeDNS(t, func(query []byte) []byte {
+		n := int(atomic.AddInt32(&count, 1))
+		if n <= len(domainNames) {
+			arrived.Done()
+		}
+		arrived.Wait()
+		time.Sleep(time.Duration(len(domainNames)-n) * 20 * time.Millisecond)
+		return testEcho(query)
+	}))
+	pool := newUpstreamPool([]*upstream{newUpstream("test", mux)}, strategyFailover, 3)
+
+	var wg sync.WaitGroup
+	for i, dn := range domainNames {
+		wg.Add(1)
+		go func(id uint16, dn string) {
+			defer wg.Done()
+			hdr := DNSMsgHdr{ID: id, FLAGS: 0x0100, QDCOUNT: 1}
+			qst := DNSMsgQst{QNAME: testQNAME(dn), QTYPE: 1, QCLASS: 1}
+			resp, _, err := communicateWithForwardDNS(pool, hdr, qst, nil, retryPolicy{timeout: time.Second})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			respHdr, respQst, _, _ := parseDNSRequest(resp)
+			if respHdr.ID != id {
+				t.Errorf("reply ID is %d, want %d", respHdr.ID, id)
+			}
+			if got := respQst.parseDomainName(); got != dn {
+				t.Errorf("reply of %s carries question %s", dn, got)
+			}
+		}(uint16(i+1), dn)
+	}
+	wg.Wait()
+
+	if len(mux.pending) != 0 {
+		t.Errorf("%d queries still pending", len(mux.pending))
+	}
+}
+
+func TestUpstreamMuxRegister(t *testing.T) {
+	mux := &upstreamMux{pending: make(map[pendingKey]chan []byte)}
+	qst := DNSMsgQst{QNAME: testQNAME("google.com"), QTYPE: 1, QCLASS: 1}
+	seen := make(map[uint16]bool)
+	for i := 0; i < 1000; i++ {
+		key, _ := mux.register(qst)
+		if seen[key.id] {
+			t.Fatalf("ID %d reserved twice", key.id)
+		}
+		seen[key.id] = true
+	}
+}